@@ -1,3 +1,11 @@
 module github.com/kasvith/simplelb
 
 go 1.13
+
+require (
+	github.com/alicebob/miniredis/v2 v2.13.0
+	github.com/prometheus/client_golang v1.11.0
+	go.uber.org/goleak v1.1.12
+	golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+)
@@ -0,0 +1,76 @@
+package lb
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// accessEntry collects what the access log records about a request while it is served
+type accessEntry struct {
+	start   time.Time
+	uri     string
+	backend string
+	tries   int
+}
+
+// unsampledRequests counts the requests without an id to sample by
+var unsampledRequests uint64
+
+// withAccessEntry returns r carrying a new access log entry, nil when the access log is disabled
+func withAccessEntry(r *http.Request) (*http.Request, *accessEntry) {
+	if cfg.AccessLogSample <= 0 {
+		return r, nil
+	}
+	entry := &accessEntry{start: time.Now(), uri: r.RequestURI}
+	return r.WithContext(context.WithValue(r.Context(), accessEntryKey, entry)), entry
+}
+
+// recordTry notes in the access log entry of r, if any, that b was tried
+func recordTry(r *http.Request, b *Backend) {
+	if entry, ok := r.Context().Value(accessEntryKey).(*accessEntry); ok {
+		entry.backend = b.URL.String()
+		entry.tries++
+	}
+}
+
+// accessSampled returns true when a successful request is in the 1 in -access-log-sample
+// logged. Requests are sampled by their trace id or X-Request-Id so every system applying
+// the same rule logs the same requests, those without either are counted
+func accessSampled(r *http.Request) bool {
+	n := uint64(cfg.AccessLogSample)
+	if n <= 1 {
+		return true
+	}
+	id := traceID(r)
+	if id == "" {
+		id = r.Header.Get("X-Request-Id")
+	}
+	if id == "" {
+		return atomic.AddUint64(&unsampledRequests, 1)%n == 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return h.Sum64()%n == 0
+}
+
+// logAccess writes the access log line of r, always for errors and retried requests
+func logAccess(r *http.Request, rw *responseWriter, entry *accessEntry) {
+	status := rw.status
+	if status == 0 {
+		// nothing was written, the client got an empty 200
+		status = http.StatusOK
+	}
+	if status < http.StatusInternalServerError && entry.tries <= 1 && !accessSampled(r) {
+		return
+	}
+	backend := entry.backend
+	if backend == "" {
+		backend = "-"
+	}
+	log.Printf("access client=%s method=%s uri=%q status=%d bytes=%d duration=%s backend=%s tries=%d\n",
+		clientIP(r), r.Method, entry.uri, status, rw.written, time.Since(entry.start), backend, entry.tries)
+}
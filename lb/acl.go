@@ -0,0 +1,107 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ACL allows or denies clients by ip, deny rules take precedence over allow rules.
+// Without allow rules every client not denied is allowed
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// parseCIDRs parses comma separated CIDRs and bare ips, which match only themselves
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, value := range values {
+		for _, tok := range strings.Split(value, ",") {
+			if tok = strings.TrimSpace(tok); tok == "" {
+				continue
+			}
+			if !strings.Contains(tok, "/") {
+				ip := net.ParseIP(tok)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid ip %q", tok)
+				}
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			_, ipNet, err := net.ParseCIDR(tok)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", tok)
+			}
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets, nil
+}
+
+// NewACL creates an ACL from lists of CIDRs
+func NewACL(allow, deny []string) (*ACL, error) {
+	a := &ACL{}
+	var err error
+	if a.Allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if a.Deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// containsIP returns true when one of nets contains ip
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns true when the client at ip may be served,
+// clients whose address cannot be parsed are only allowed without rules
+func (a *ACL) Allowed(ip string) bool {
+	if len(a.Allow) == 0 && len(a.Deny) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || containsIP(a.Deny, parsed) {
+		return false
+	}
+	return len(a.Allow) == 0 || containsIP(a.Allow, parsed)
+}
+
+// cidrStrings returns nets in CIDR notation
+func cidrStrings(nets []*net.IPNet) []string {
+	values := make([]string, len(nets))
+	for i, n := range nets {
+		values[i] = n.String()
+	}
+	return values
+}
+
+// acl holds the *ACL clients are checked against, it is replaced through the admin api
+var acl atomic.Value
+
+// currentACL returns the ACL in effect
+func currentACL() *ACL {
+	a, _ := acl.Load().(*ACL)
+	if a == nil {
+		return &ACL{}
+	}
+	return a
+}
+
+// setACL replaces the ACL in effect
+func setACL(a *ACL) {
+	acl.Store(a)
+}
@@ -0,0 +1,94 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxAdaptivePenalty keeps at least this share of a slow backend's weight so its latency keeps being sampled
+const maxAdaptivePenalty = 0.9
+
+// adaptiveSmoothing is how far the penalty moves towards its target on every run, damping oscillation
+const adaptiveSmoothing = 0.5
+
+// loadSmoothing is the weight given to the latest load a backend reported, damping oscillation
+const loadSmoothing = 0.2
+
+// reportedLoad returns the load a backend reported in the -load-header of response,
+// false when not reported or not a number
+func reportedLoad(response *http.Response) (float64, bool) {
+	if cfg.LoadHeader == "" {
+		return 0, false
+	}
+	value := response.Header.Get(cfg.LoadHeader)
+	if value == "" {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return load, true
+}
+
+// observeLoad moves the load of this backend towards a reported load, from 0 for idle
+// to 1 for saturated, capped so a saturated backend still gets its load sampled
+func (b *Backend) observeLoad(load float64) {
+	switch {
+	case load < 0:
+		load = 0
+	case load > maxAdaptivePenalty:
+		load = maxAdaptivePenalty
+	}
+	b.mux.Lock()
+	b.load += loadSmoothing * (load - b.load)
+	b.mux.Unlock()
+}
+
+// adaptWeights lowers the effective weight of the backends of pool in proportion to how much
+// slower than the median backend they respond, and restores it as they catch up
+func adaptWeights(pool *ServerPool) {
+	var sampled []*Backend
+	var latencies []float64
+	for _, b := range pool.Backends() {
+		if b.IsAvailable() && b.Latency() > 0 {
+			sampled = append(sampled, b)
+			latencies = append(latencies, float64(b.Latency()))
+		}
+	}
+	if len(sampled) < 2 {
+		return
+	}
+	sort.Float64s(latencies)
+	median := latencies[(len(latencies)-1)/2] // the lower median, so one of two backends can be slow
+
+	for _, b := range sampled {
+		target := 0.0
+		if latency := float64(b.Latency()); latency > median {
+			target = 1 - median/latency
+		}
+		if target > maxAdaptivePenalty {
+			target = maxAdaptivePenalty
+		}
+		b.adjustPenalty(target)
+	}
+}
+
+// runAdaptiveWeights adapts the weights of every pool on the given interval until ctx is done
+func runAdaptiveWeights(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for _, pool := range currentRouter().Pools() {
+				adaptWeights(pool)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,622 @@
+package lb
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// backendStatus is the admin api representation of a backend, the effective weight
+// is what is left of the weight after the adaptive weights penalized a slow backend,
+// the certificate expiry is given in whole days for https backends and the last error
+// tells why a backend failed until it recovers. The failure score weighs its failures
+// within -eject-window when -eject-failures is set and the success rate is the share of
+// its requests within -success-rate-window which succeeded when that is set
+type backendStatus struct {
+	Pool            string            `json:"pool"`
+	URL             string            `json:"url"`
+	Alive           bool              `json:"alive"`
+	Weight          int               `json:"weight"`
+	EffectiveWeight float64           `json:"effective_weight"`
+	Priority        int               `json:"priority"`
+	MaxConns        int64             `json:"max_conns,omitempty"`
+	Draining        bool              `json:"draining,omitempty"`
+	DrainUntil      *time.Time        `json:"drain_until,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+	CertExpiryDays  *int              `json:"cert_expiry_days,omitempty"`
+	LastError       string            `json:"last_error,omitempty"`
+	LastErrorAt     *time.Time        `json:"last_error_at,omitempty"`
+	FailureScore    float64           `json:"failure_score,omitempty"`
+	SuccessRate     *float64          `json:"success_rate,omitempty"`
+}
+
+// newBackendStatus takes a snapshot of b in pool for the admin api
+func newBackendStatus(pool *ServerPool, b *Backend) backendStatus {
+	status := backendStatus{
+		Pool:            pool.Name(),
+		URL:             b.URL.String(),
+		Alive:           b.IsAlive(),
+		Weight:          b.Weight(),
+		EffectiveWeight: b.EffectiveWeight(),
+		Priority:        b.Priority,
+		MaxConns:        b.MaxConns,
+		Draining:        b.Draining(),
+		FailureScore:    b.FailureScore(),
+		Tags:            b.Tags,
+	}
+	if notAfter, ok := certExpiry(b.URL); ok {
+		days := int(time.Until(notAfter).Hours() / 24)
+		status.CertExpiryDays = &days
+	}
+	if lastError, at := b.LastError(); lastError != "" {
+		status.LastError = lastError
+		status.LastErrorAt = &at
+	}
+	if until := b.DrainUntil(); !until.IsZero() {
+		status.DrainUntil = &until
+	}
+	if rate, ok := b.SuccessRate(); ok {
+		status.SuccessRate = &rate
+	}
+	return status
+}
+
+// writeJSON writes v as the json response body with the given status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logErrorf("Failed to write admin response, error: %v\n", err)
+	}
+}
+
+// backendURLFromQuery parses the backend url given in the url query parameter
+func backendURLFromQuery(r *http.Request) (*url.URL, bool) {
+	raw := r.URL.Query().Get("url")
+	if raw == "" {
+		return nil, false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+// weightFromQuery parses the weight query parameter, returning def when it is absent
+func weightFromQuery(r *http.Request, def int) (int, bool) {
+	raw := r.URL.Query().Get("weight")
+	if raw == "" {
+		return def, true
+	}
+	weight, err := strconv.Atoi(raw)
+	if err != nil || weight < 0 {
+		return 0, false
+	}
+	return weight, true
+}
+
+// poolsFromQuery returns the pool given in the pool query parameter,
+// or every pool for listings without one
+func poolsFromQuery(r *http.Request) []*ServerPool {
+	name := r.URL.Query().Get("pool")
+	if name == "" {
+		if r.Method == http.MethodGet {
+			return currentRouter().Pools()
+		}
+		name = DefaultPool
+	}
+	if pool := currentRouter().Pool(name); pool != nil {
+		return []*ServerPool{pool}
+	}
+	return nil
+}
+
+// handleBackends lists, adds, updates and removes backends of the server pools
+func handleBackends(w http.ResponseWriter, r *http.Request) {
+	pools := poolsFromQuery(r)
+	if len(pools) == 0 {
+		http.Error(w, "Pool not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		statuses := make([]backendStatus, 0)
+		for _, pool := range pools {
+			for _, b := range pool.Backends() {
+				statuses = append(statuses, newBackendStatus(pool, b))
+			}
+		}
+		writeJSON(w, http.StatusOK, statuses)
+		return
+	}
+
+	pool := pools[0]
+	backendUrl, ok := backendURLFromQuery(r)
+	if !ok {
+		http.Error(w, "A valid backend url is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if pool.GetBackend(backendUrl) != nil {
+			http.Error(w, "Backend already exists", http.StatusConflict)
+			return
+		}
+		if isSelf(backendUrl) {
+			http.Error(w, "Backend points at the load balancer itself", http.StatusBadRequest)
+			return
+		}
+		if pool.MaxSize > 0 && len(pool.Backends()) >= pool.MaxSize {
+			http.Error(w, "Pool is at its maximum size", http.StatusConflict)
+			return
+		}
+		weight, ok := weightFromQuery(r, 1)
+		if !ok {
+			http.Error(w, "Weight must be a non negative integer", http.StatusBadRequest)
+			return
+		}
+		backend := NewBackend(backendUrl)
+		backend.SetWeight(weight)
+		pool.AddBackend(backend)
+		logInfof("Added server: %s (pool %s)\n", backend.URL, pool.Name())
+		publishBackendEvent(EventAdded, backend, "")
+		warnUnlabeledTags(backend)
+		startPriming(backend)
+		writeJSON(w, http.StatusCreated, newBackendStatus(pool, backend))
+	case http.MethodPatch:
+		backend := pool.GetBackend(backendUrl)
+		if backend == nil {
+			http.Error(w, "Backend not found", http.StatusNotFound)
+			return
+		}
+		weight, ok := weightFromQuery(r, backend.Weight())
+		if !ok {
+			http.Error(w, "Weight must be a non negative integer", http.StatusBadRequest)
+			return
+		}
+		drainValue := r.URL.Query().Get("drain")
+		drain, err := strconv.ParseBool(drainValue)
+		if drainValue != "" && err != nil {
+			http.Error(w, "Drain must be true or false", http.StatusBadRequest)
+			return
+		}
+		backend.SetWeight(weight)
+		logInfof("Updated server: %s (pool %s) weight %d\n", backend.URL, pool.Name(), weight)
+		events.Publish(Event{Type: EventWeight, Pool: pool.Name(), Backend: backend.URL.String(), Weight: &weight})
+		if drainValue != "" && backend.SetDraining(drain) {
+			if drain {
+				logInfof("Draining server: %s (pool %s)\n", backend.URL, pool.Name())
+				publishBackendEvent(EventDrain, backend, "")
+			} else {
+				logInfof("Stopped draining server: %s (pool %s)\n", backend.URL, pool.Name())
+				publishBackendEvent(EventUndrain, backend, "")
+			}
+		}
+		writeJSON(w, http.StatusOK, newBackendStatus(pool, backend))
+	case http.MethodDelete:
+		if pool.GetBackend(backendUrl) != nil && len(pool.Backends()) <= pool.MinSize {
+			http.Error(w, "Pool is at its minimum size", http.StatusConflict)
+			return
+		}
+		if !pool.RemoveBackend(backendUrl) {
+			http.Error(w, "Backend not found", http.StatusNotFound)
+			return
+		}
+		logInfof("Removed server: %s (pool %s)\n", withoutUserinfo(backendUrl), pool.Name())
+		events.Publish(Event{Type: EventRemoved, Pool: pool.Name(), Backend: withoutUserinfo(backendUrl).String()})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, PATCH, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sensitiveFlags are the flags whose values are never shown by the admin api,
+// the urls of every other flag have their credentials hidden
+var sensitiveFlags = map[string]bool{
+	"admin-password": true,
+	"admin-token":    true,
+	"autocert-cache": true,
+	"tls-key":        true,
+}
+
+// redacted is shown in place of secrets
+const redacted = "REDACTED"
+
+// redactURLs hides the credentials of the comma separated urls in value, the password
+// or a lone user name which is often a token
+func redactURLs(value string) string {
+	tokens := strings.Split(value, ",")
+	for i, tok := range tokens {
+		u, err := url.Parse(tok)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		} else {
+			u.User = url.User(redacted)
+		}
+		tokens[i] = u.String()
+	}
+	return strings.Join(tokens, ",")
+}
+
+// poolConfigStatus is the admin api representation of a pool's effective config
+type poolConfigStatus struct {
+	Name     string   `json:"name"`
+	Strategy string   `json:"strategy"`
+	Backends []string `json:"backends"`
+}
+
+// routeStatus is the admin api representation of a route
+type routeStatus struct {
+	Pattern          string `json:"pattern"`
+	MinContentLength int64  `json:"min_content_length,omitempty"`
+	ContentType      string `json:"content_type,omitempty"`
+	Pool             string `json:"pool"`
+	Timeout          string `json:"timeout,omitempty"`
+	MaxAttempts      int    `json:"max_attempts,omitempty"`
+	RetryOn          string `json:"retry_on,omitempty"`
+}
+
+// configStatus is the admin api representation of the effective config
+type configStatus struct {
+	Settings map[string]string  `json:"settings"`
+	Pools    []poolConfigStatus `json:"pools"`
+	Routes   []routeStatus      `json:"routes"`
+}
+
+// handleConfig shows the effective config with the secrets redacted
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := configStatus{
+		Settings: make(map[string]string),
+		Pools:    make([]poolConfigStatus, 0),
+		Routes:   make([]routeStatus, 0),
+	}
+	// the settings are rendered from the effective config through a flag set of its own,
+	// the flags of a program embedding the load balancer are none of its business
+	var c Config
+	fs := flag.NewFlagSet("simplelb", flag.ContinueOnError)
+	RegisterFlags(fs, &c)
+	c = cfg
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if sensitiveFlags[f.Name] && value != "" {
+			value = redacted
+		}
+		status.Settings[f.Name] = redactURLs(value)
+	})
+	for _, pool := range currentRouter().Pools() {
+		pcs := poolConfigStatus{
+			Name:     pool.Name(),
+			Strategy: balancerName(pool.Balancer()),
+			Backends: make([]string, 0),
+		}
+		for _, b := range pool.Backends() {
+			pcs.Backends = append(pcs.Backends, redactURLs(b.URL.String()))
+		}
+		status.Pools = append(status.Pools, pcs)
+	}
+	for _, route := range currentRouter().Routes() {
+		rs := routeStatus{
+			Pattern:          route.Pattern.String(),
+			MinContentLength: route.Body.MinContentLength,
+			ContentType:      route.Body.ContentType,
+			Pool:             route.Pool.Name(),
+			MaxAttempts:      route.Policy.MaxAttempts,
+			RetryOn:          route.Policy.RetryOn.String(),
+		}
+		if route.Policy.Timeout > 0 {
+			rs.Timeout = route.Policy.Timeout.String()
+		}
+		status.Routes = append(status.Routes, rs)
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleReset resets the backend given in the url query parameter, or every backend of
+// the pools given when there is none, responding with their state after the reset
+func handleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pools := currentRouter().Pools()
+	if name := r.URL.Query().Get("pool"); name != "" {
+		if pool := currentRouter().Pool(name); pool != nil {
+			pools = []*ServerPool{pool}
+		} else {
+			pools = nil
+		}
+	}
+	if len(pools) == 0 {
+		http.Error(w, "Pool not found", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("url") == "" {
+		statuses := make([]backendStatus, 0)
+		for _, pool := range pools {
+			for _, b := range pool.Backends() {
+				b.Reset()
+				statuses = append(statuses, newBackendStatus(pool, b))
+			}
+			logInfof("Reset every server of pool %s\n", pool.Name())
+		}
+		writeJSON(w, http.StatusOK, statuses)
+		return
+	}
+
+	backendUrl, ok := backendURLFromQuery(r)
+	if !ok {
+		http.Error(w, "A valid backend url is required", http.StatusBadRequest)
+		return
+	}
+	for _, pool := range pools {
+		if b := pool.GetBackend(backendUrl); b != nil {
+			b.Reset()
+			logInfof("Reset server: %s (pool %s)\n", b.URL, pool.Name())
+			writeJSON(w, http.StatusOK, newBackendStatus(pool, b))
+			return
+		}
+	}
+	http.Error(w, "Backend not found", http.StatusNotFound)
+}
+
+// poolSummary is the admin api summary of a pool, the active tier is
+// the priority of the backends taking its traffic
+type poolSummary struct {
+	Name       string `json:"name"`
+	Strategy   string `json:"strategy"`
+	Backends   int    `json:"backends"`
+	Alive      int    `json:"alive"`
+	ActiveTier *int   `json:"active_tier,omitempty"`
+}
+
+// summary is the admin api landing page
+type summary struct {
+	Backends int           `json:"backends"`
+	Alive    int           `json:"alive"`
+	Uptime   string        `json:"uptime"`
+	Requests uint64        `json:"requests"`
+	InFlight int64         `json:"in_flight"`
+	Pools    []poolSummary `json:"pools"`
+}
+
+// handleSummary shows the number of backends and their health at a glance
+func handleSummary(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := summary{
+		Uptime:   time.Since(startTime).Round(time.Second).String(),
+		Requests: atomic.LoadUint64(&totalRequests),
+		InFlight: atomic.LoadInt64(&inFlight),
+		Pools:    make([]poolSummary, 0),
+	}
+	for _, pool := range currentRouter().Pools() {
+		ps := poolSummary{Name: pool.Name(), Strategy: balancerName(pool.Balancer())}
+		if tier, ok := pool.ActiveTier(); ok {
+			ps.ActiveTier = &tier
+		}
+		for _, b := range pool.Backends() {
+			ps.Backends++
+			if b.IsAlive() {
+				ps.Alive++
+			}
+		}
+		s.Backends += ps.Backends
+		s.Alive += ps.Alive
+		s.Pools = append(s.Pools, ps)
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// logLevelStatus is the admin api representation of the log level
+type logLevelStatus struct {
+	Level string `json:"level"`
+}
+
+// handleLogLevel shows the log level and changes it to the one in the level query parameter
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		level, err := parseLogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setLogLevel(level)
+		logInfof("Log level changed to %s\n", level)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, logLevelStatus{Level: currentLogLevel().String()})
+}
+
+// aclStatus is the admin api representation of the client ACL
+type aclStatus struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// handleACL shows the client ACL or replaces it with the one in the request body
+func handleACL(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var status aclStatus
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			http.Error(w, "invalid acl: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		a, err := NewACL(status.Allow, status.Deny)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setACL(a)
+		logInfof("Client ACL changed, %d allow and %d deny rules\n", len(a.Allow), len(a.Deny))
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a := currentACL()
+	writeJSON(w, http.StatusOK, aclStatus{Allow: cidrStrings(a.Allow), Deny: cidrStrings(a.Deny)})
+}
+
+// handleEvents streams the backend events as server sent events until the client goes away
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// authorized returns true when the request carries the configured admin credentials
+func authorized(r *http.Request) bool {
+	if cfg.AdminToken != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(cfg.AdminToken)) == 1 {
+			return true
+		}
+	}
+	if cfg.AdminUser != "" {
+		user, password, ok := r.BasicAuth()
+		if ok &&
+			subtle.ConstantTimeCompare([]byte(user), []byte(cfg.AdminUser)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(cfg.AdminPassword)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAuth rejects admin requests without valid credentials, when any are configured
+func requireAuth(next http.Handler) http.Handler {
+	if cfg.AdminToken == "" && cfg.AdminUser == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			if cfg.AdminUser != "" {
+				w.Header().Add("WWW-Authenticate", `Basic realm="simplelb"`)
+			}
+			if cfg.AdminToken != "" {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="simplelb"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminHandler routes the admin api endpoints, guarded by the admin credentials of the config
+func AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleSummary)
+	mux.HandleFunc("/acl", handleACL)
+	mux.HandleFunc("/backends", handleBackends)
+	mux.HandleFunc("/backends/reset", handleReset)
+	mux.HandleFunc("/config", handleConfig)
+	mux.HandleFunc("/events", handleEvents)
+	mux.HandleFunc("/loglevel", handleLogLevel)
+	mux.Handle("/metrics", metricsHandler())
+	if cfg.Pprof {
+		// profiles of the load balancer itself, guarded by the admin credentials like the rest.
+		// The command line is left out, it holds the secrets /config redacts
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return requireAuth(mux)
+}
+
+// newAdminServer creates the server of the admin api at addr
+func newAdminServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           AdminHandler(),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// serveAdmin serves the admin api on ln until the server is shut down
+func serveAdmin(server *http.Server, ln net.Listener) {
+	if cfg.AdminToken == "" && cfg.AdminUser == "" {
+		logWarnf("Admin API has no credentials configured, anyone reaching it can modify backends\n")
+	}
+
+	logInfof("Admin API started at %s\n", server.Addr)
+	if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
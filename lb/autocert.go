@@ -0,0 +1,58 @@
+package lb
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// letsEncryptStaging is the ACME directory of the Let's Encrypt staging environment,
+// issuing untrusted certificates under far higher rate limits
+const letsEncryptStaging = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// newCertManager creates the manager obtaining and renewing the certificates of the
+// -autocert domains from Let's Encrypt, caching them in -autocert-cache
+func newCertManager() *autocert.Manager {
+	var domains []string
+	for _, value := range cfg.Autocert {
+		for _, tok := range strings.Split(value, ",") {
+			if tok = strings.TrimSpace(tok); tok != "" {
+				domains = append(domains, tok)
+			}
+		}
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cfg.AutocertCache),
+		Email:      cfg.AutocertEmail,
+	}
+	if cfg.AutocertStaging {
+		m.Client = &acme.Client{DirectoryURL: letsEncryptStaging}
+	}
+	return m
+}
+
+// newChallengeServer creates the server answering the ACME HTTP-01 challenges of m,
+// redirecting any other request to https
+func newChallengeServer(m *autocert.Manager) *http.Server {
+	return &http.Server{
+		Addr:              cfg.AutocertHTTPAddr,
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// serveChallenges serves the ACME challenges on ln until the server is shut down
+func serveChallenges(server *http.Server, ln net.Listener) {
+	logInfof("ACME challenges served at %s\n", server.Addr)
+	if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,46 @@
+package lb
+
+import (
+	"math/rand"
+	"time"
+)
+
+// probeDue returns true when b is to be health checked at now, false while a dead
+// backend backs off
+func (b *Backend) probeDue(now time.Time) bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.nextProbe.IsZero() || !now.Before(b.nextProbe)
+}
+
+// observeProbe records the outcome of a health check of b at now. With -health-backoff-max
+// every consecutive failure doubles the delay until the next check, starting from the
+// health check interval and capped at -health-backoff-max. The delay is jittered between
+// half and all of it so the dead backends of many load balancers are not probed together.
+// A passing check resets the backoff
+func (b *Backend) observeProbe(alive bool, now time.Time) time.Duration {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if alive || cfg.HealthBackoffMax <= 0 {
+		b.probeFailures = 0
+		b.nextProbe = time.Time{}
+		return 0
+	}
+
+	b.probeFailures++
+	delay := cfg.HealthBackoffMax
+	if shift := uint(b.probeFailures - 1); shift < 32 && healthCheckInterval<<shift < delay {
+		delay = healthCheckInterval << shift
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	b.nextProbe = now.Add(delay)
+	return delay
+}
+
+// resetProbes forgets the failed health checks of b so it is checked in the next round
+func (b *Backend) resetProbes() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.probeFailures = 0
+	b.nextProbe = time.Time{}
+}
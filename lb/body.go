@@ -0,0 +1,184 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errBodyTimeout is returned by request bodies which stalled for longer than -body-read-timeout
+var errBodyTimeout = errors.New("request body stalled")
+
+// bodyRead is the outcome of a read from a client body
+type bodyRead struct {
+	n   int
+	err error
+}
+
+// timeoutBody fails reads of a client body which wait longer than timeout for data,
+// so a client trickling its body cannot hold on to a backend connection
+type timeoutBody struct {
+	body     io.ReadCloser
+	timeout  time.Duration
+	buf      []byte
+	result   chan bodyRead
+	timedOut int32
+}
+
+// withBodyTimeout wraps the body of r with the -body-read-timeout, if any
+func withBodyTimeout(r *http.Request) {
+	if cfg.BodyReadTimeout <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	r.Body = &timeoutBody{body: r.Body, timeout: cfg.BodyReadTimeout, result: make(chan bodyRead, 1)}
+}
+
+// Read reads from the client body in the background, giving up after the timeout.
+// The stalled read is left to the server read timeout and every later read fails
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&b.timedOut) == 1 {
+		return 0, errBodyTimeout
+	}
+	if cap(b.buf) < len(p) {
+		b.buf = make([]byte, len(p))
+	}
+	buf := b.buf[:len(p)]
+	go func() {
+		n, err := b.body.Read(buf)
+		b.result <- bodyRead{n: n, err: err}
+	}()
+
+	timer := time.NewTimer(b.timeout)
+	defer timer.Stop()
+	select {
+	case read := <-b.result:
+		return copy(p, buf[:read.n]), read.err
+	case <-timer.C:
+		atomic.StoreInt32(&b.timedOut, 1)
+		return 0, errBodyTimeout
+	}
+}
+
+// Close closes the client body unless a read is still stalled on it
+func (b *timeoutBody) Close() error {
+	if atomic.LoadInt32(&b.timedOut) == 1 {
+		return nil
+	}
+	return b.body.Close()
+}
+
+// replayableMethods are the idempotent methods whose bodies are buffered with -retry-body-max
+var replayableMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// bufferRetryBody buffers the body of an idempotent request r of up to -retry-body-max
+// bytes and sets its GetBody, so the request can be replayed on a retry or failover.
+// Other bodies are streamed, their requests are only retried when no backend read them
+func bufferRetryBody(r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	if cfg.RetryBodyMax <= 0 || !replayableMethods[r.Method] || r.ContentLength > cfg.RetryBodyMax {
+		r.Body = &streamedBody{ReadCloser: r.Body}
+		return
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, cfg.RetryBodyMax+1))
+	if err != nil || int64(len(buf)) > cfg.RetryBodyMax {
+		// give the backend everything read so far followed by the rest, or the read error
+		r.Body = &streamedBody{ReadCloser: readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}}
+		return
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+}
+
+// the states of a streamed body
+const (
+	streamUnread int32 = iota
+	streamRead
+	streamReplayed
+)
+
+// errBodyReplayed is returned by a streamed body handed over to another attempt
+var errBodyReplayed = errors.New("request body sent again")
+
+// streamedBody passes on a body which is not buffered. A request failing before a
+// backend read any of it, like on a refused connection, can still be sent again
+type streamedBody struct {
+	io.ReadCloser
+	state int32
+}
+
+// Read reads from the body unless it was handed over to another attempt
+func (b *streamedBody) Read(p []byte) (int, error) {
+	if !atomic.CompareAndSwapInt32(&b.state, streamUnread, streamRead) && atomic.LoadInt32(&b.state) == streamReplayed {
+		return 0, errBodyReplayed
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// Close closes the body once it was read, the transport closes it on errors as well
+// and an unread body may still be sent again, the server closes it in the end
+func (b *streamedBody) Close() error {
+	if atomic.LoadInt32(&b.state) != streamRead {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// replay hands the unread body over to another attempt, false once a backend read it
+func (b *streamedBody) replay() (*streamedBody, bool) {
+	if !atomic.CompareAndSwapInt32(&b.state, streamUnread, streamReplayed) {
+		return nil, false
+	}
+	return &streamedBody{ReadCloser: b.ReadCloser}, true
+}
+
+// replayable returns true when the body of r can be sent again
+func replayable(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+// rewindBody returns r ready to be sent again with its body from the start, false when
+// the body was streamed to the backend already and cannot be sent again
+func rewindBody(r *http.Request) (*http.Request, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return r, true
+	}
+	body := r.Body
+	// the backend request counts the bytes sent of the client body
+	if counted, ok := body.(*countingBody); ok {
+		body = counted.ReadCloser
+	}
+	if streamed, ok := body.(*streamedBody); ok {
+		replayed, ok := streamed.replay()
+		if !ok {
+			return r, false
+		}
+		rewound := r.WithContext(r.Context())
+		rewound.Body = replayed
+		return rewound, true
+	}
+	if r.GetBody == nil {
+		return r, false
+	}
+	body, err := r.GetBody()
+	if err != nil {
+		return r, false
+	}
+	rewound := r.WithContext(r.Context())
+	rewound.Body = body
+	return rewound, true
+}
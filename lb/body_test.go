@@ -0,0 +1,61 @@
+package lb
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readTracker records whether its reader was read from
+type readTracker struct {
+	io.Reader
+	read bool
+}
+
+func (t *readTracker) Read(p []byte) (int, error) {
+	t.read = true
+	return t.Reader.Read(p)
+}
+
+func TestDeniedRequestBodyIsNotBuffered(t *testing.T) {
+	c := DefaultConfig()
+	c.Deny = StringList{"192.0.2.1"}
+	c.RetryBodyMax = 1024
+	if err := Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(DefaultConfig())
+
+	body := &readTracker{Reader: strings.NewReader("payload")}
+	r := httptest.NewRequest(http.MethodPut, "/", body)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	serve(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if body.read {
+		t.Error("body of a denied request was read")
+	}
+}
+
+func TestStreamedBodyReplay(t *testing.T) {
+	unread := &streamedBody{ReadCloser: ioutil.NopCloser(strings.NewReader("payload"))}
+	replayed, ok := unread.replay()
+	if !ok {
+		t.Fatal("unread body not replayed")
+	}
+	if _, err := unread.Read(make([]byte, 1)); err != errBodyReplayed {
+		t.Errorf("read of a replayed body = %v, want %v", err, errBodyReplayed)
+	}
+	if b, _ := ioutil.ReadAll(replayed); string(b) != "payload" {
+		t.Errorf("replayed body = %q, want the whole body", b)
+	}
+	if _, ok := replayed.replay(); ok {
+		t.Error("body replayed after a backend read it")
+	}
+}
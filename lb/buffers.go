@@ -0,0 +1,37 @@
+package lb
+
+import (
+	"sync"
+)
+
+// BufferPool hands out the buffers the reverse proxies copy bodies with, reusing them
+// across requests instead of allocating a new one for every response
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool creates a pool of buffers of size bytes
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() interface{} {
+		return make([]byte, p.size)
+	}
+	return p
+}
+
+// Get returns a buffer from the pool
+func (p *BufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+// Put returns a buffer to the pool, buffers of another size are dropped
+func (p *BufferPool) Put(b []byte) {
+	if cap(b) != p.size {
+		return
+	}
+	p.pool.Put(b[:p.size])
+}
+
+// proxyBuffers is the pool shared by every reverse proxy and tunnel, sized by -proxy-buffer-size
+var proxyBuffers = NewBufferPool(32 * 1024)
@@ -0,0 +1,64 @@
+package lb
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := NewBufferPool(16)
+	if n := len(p.Get()); n != 16 {
+		t.Errorf("buffer of %d bytes, want 16", n)
+	}
+	// buffers of another size are never handed out
+	p.Put(make([]byte, 8))
+	if n := len(p.Get()); n != 16 {
+		t.Errorf("buffer of %d bytes after putting a smaller one, want 16", n)
+	}
+}
+
+// discardWriter is a response writer dropping everything written to it
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+// benchmarkProxy proxies 1MB responses copied with buffers from pool, or allocated
+// for every response when it is nil
+func benchmarkProxy(b *testing.B, pool httputil.BufferPool) {
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.BufferPool = pool
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			proxy.ServeHTTP(discardWriter{header: make(http.Header)}, httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+	})
+}
+
+func BenchmarkProxyPooledBuffers(b *testing.B) {
+	benchmarkProxy(b, NewBufferPool(32*1024))
+}
+
+func BenchmarkProxyUnpooledBuffers(b *testing.B) {
+	benchmarkProxy(b, nil)
+}
@@ -0,0 +1,53 @@
+package lb_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kasvith/simplelb/lb"
+	"github.com/kasvith/simplelb/lb/lbtest"
+)
+
+func TestCancelledRequestIsNotRetried(t *testing.T) {
+	slow, other := lbtest.NewBackend(), lbtest.NewBackend()
+	defer slow.Close()
+	defer other.Close()
+	slow.SetLatency(300 * time.Millisecond)
+
+	l, err := lbtest.Start(lb.DefaultConfig(), &lb.RoundRobin{}, slow, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, l.URL+"/", nil)
+	if _, err := l.Client().Do(req.WithContext(ctx)); err == nil {
+		t.Fatal("request of a client which went away succeeded")
+	}
+	select {
+	case <-slow.Cancelled():
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request not cancelled along with the client request")
+	}
+	// Close waits for the load balancer to finish the request, a retry or failover included
+	l.Close()
+
+	if slow.Cancellations() != 1 {
+		t.Errorf("slow backend saw %d cancelled requests, want 1", slow.Cancellations())
+	}
+	if slow.Hits() != 1 {
+		t.Errorf("slow backend got %d requests, want 1", slow.Hits())
+	}
+	if other.Hits() != 0 {
+		t.Errorf("request failed over to another backend %d times after the client went away", other.Hits())
+	}
+	for _, b := range l.Pool.Backends() {
+		if !b.IsAlive() {
+			t.Errorf("%s marked down for a client going away", b.URL)
+		}
+	}
+}
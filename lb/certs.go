@@ -0,0 +1,98 @@
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often the TLS certificate files are checked for changes
+const certReloadInterval = 10 * time.Second
+
+// CertReloader serves the certificate in CertFile and KeyFile to clients,
+// picking up a rotated certificate without a restart
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	mux      sync.RWMutex
+	cert     *tls.Certificate
+	stamp    string
+}
+
+// NewCertReloader loads the certificate in certFile and keyFile
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.cert, nil
+}
+
+// fileStamp identifies the content of the certificate files by their size and modification time
+func (c *CertReloader) fileStamp() (string, error) {
+	var stamp string
+	for _, path := range []string{c.CertFile, c.KeyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d/%d;", info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
+
+// Reload loads the certificate again when either file changed, returning whether it did.
+// The current certificate is kept while the files do not hold a matching pair, such as
+// when the certificate was written but the key not yet, so the next Reload tries again
+func (c *CertReloader) Reload() (bool, error) {
+	stamp, err := c.fileStamp()
+	if err != nil {
+		return false, err
+	}
+	c.mux.RLock()
+	unchanged := stamp == c.stamp
+	c.mux.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mux.Lock()
+	c.cert = &cert
+	c.stamp = stamp
+	c.mux.Unlock()
+	return true, nil
+}
+
+// Run reloads the certificate every interval until ctx is done
+func (c *CertReloader) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			reloaded, err := c.Reload()
+			switch {
+			case err != nil:
+				logWarnf("Keeping the current TLS certificate: %s\n", err)
+			case reloaded:
+				logInfof("Reloaded TLS certificate %s\n", c.CertFile)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
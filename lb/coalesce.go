@@ -0,0 +1,153 @@
+package lb
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// coalesceMaxBody is the largest response body shared with coalesced requests,
+// larger responses are only streamed to the request which fetched them
+const coalesceMaxBody = 1 << 20
+
+// coalesced groups the identical requests in flight
+var coalesced singleflight.Group
+
+// coalescable returns true for requests which may share the response of an identical
+// one, GET and HEAD requests without credentials which accept a cached response
+func coalescable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" || r.Header.Get("Range") != "" ||
+		r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	for _, value := range r.Header["Cache-Control"] {
+		if strings.Contains(value, "no-cache") || strings.Contains(value, "no-store") {
+			return false
+		}
+	}
+	return !strings.Contains(r.Header.Get("Pragma"), "no-cache")
+}
+
+// coalesceKey identifies the requests sharing a response, those negotiating another
+// representation do not
+func coalesceKey(r *http.Request) string {
+	return r.Method + " " + r.Host + r.URL.RequestURI() + " " + r.Header.Get("Accept-Encoding") + " " +
+		r.Header.Get("Accept") + " " + r.Header.Get("Accept-Language")
+}
+
+// sharedResponse is the response the request which reached a backend shares with the
+// identical requests which waited for it
+type sharedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// teeWriter writes a response to the client while keeping a copy to share
+type teeWriter struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+// WriteHeader takes a snapshot of the headers before sending them
+func (t *teeWriter) WriteHeader(code int) {
+	if t.status == 0 {
+		t.status = code
+		t.header = cloneHeader(t.Header())
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+// Write sends b to the client, keeping a copy unless the body grew too large
+func (t *teeWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	if !t.overflow {
+		if t.body.Len()+len(b) > coalesceMaxBody {
+			t.overflow = true
+			t.body.Reset()
+		} else {
+			t.body.Write(b)
+		}
+	}
+	return t.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client
+func (t *teeWriter) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// shared returns the response to share, nil when it must not be shared because it is
+// too large, private to the client or an error
+func (t *teeWriter) shared() *sharedResponse {
+	if t.overflow || t.status == 0 || t.status >= http.StatusInternalServerError {
+		return nil
+	}
+	if t.header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	// a response varying on anything but the encoding, which is part of the key,
+	// may be meant for this client only
+	for _, value := range t.header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" && !strings.EqualFold(name, "Accept-Encoding") {
+				return nil
+			}
+		}
+	}
+	for _, value := range t.header["Cache-Control"] {
+		if strings.Contains(value, "private") || strings.Contains(value, "no-store") {
+			return nil
+		}
+	}
+	return &sharedResponse{status: t.status, header: t.header, body: t.body.Bytes()}
+}
+
+// cloneHeader returns a deep copy of h
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for name, values := range h {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// coalesce serves r with forward unless an identical request is in flight, in which
+// case r waits for it and gets the same response. Requests whose response cannot be
+// shared are forwarded on their own after all
+func coalesce(w http.ResponseWriter, r *http.Request, forward func(http.ResponseWriter, *http.Request)) {
+	leader := false
+	v, _, _ := coalesced.Do(coalesceKey(r), func() (interface{}, error) {
+		leader = true
+		tee := &teeWriter{ResponseWriter: w}
+		forward(tee, r)
+		return tee.shared(), nil
+	})
+	if leader {
+		return
+	}
+
+	response := v.(*sharedResponse)
+	if response == nil {
+		forward(w, r)
+		return
+	}
+	logDebugf("%s(%s) Coalesced with an identical request\n", r.RemoteAddr, r.URL.Path)
+	for name, values := range response.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(response.status)
+	w.Write(response.body)
+}
@@ -0,0 +1,66 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCoalescable(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header string
+		value  string
+		want   bool
+	}{
+		{"get", http.MethodGet, "", "", true},
+		{"post", http.MethodPost, "", "", false},
+		{"authorization", http.MethodGet, "Authorization", "Bearer token", false},
+		{"cookie", http.MethodGet, "Cookie", "session=1", false},
+		{"range", http.MethodGet, "Range", "bytes=0-1", false},
+		{"no-cache", http.MethodGet, "Cache-Control", "no-cache", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got := coalescable(r); got != tt.want {
+			t.Errorf("%s: coalescable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCoalesceKeyNegotiation(t *testing.T) {
+	base := httptest.NewRequest(http.MethodGet, "/a?b=c", nil)
+	for _, name := range []string{"Accept", "Accept-Encoding", "Accept-Language"} {
+		r := httptest.NewRequest(http.MethodGet, "/a?b=c", nil)
+		r.Header.Set(name, "other")
+		if coalesceKey(r) == coalesceKey(base) {
+			t.Errorf("requests with another %s share a key", name)
+		}
+	}
+}
+
+func TestSharedVary(t *testing.T) {
+	tests := []struct {
+		vary []string
+		want bool
+	}{
+		{nil, true},
+		{[]string{"Accept-Encoding"}, true},
+		{[]string{"accept-encoding"}, true},
+		{[]string{"Accept-Encoding, User-Agent"}, false},
+		{[]string{"Accept-Encoding", "Authorization"}, false},
+		{[]string{"*"}, false},
+	}
+	for _, tt := range tests {
+		tee := &teeWriter{ResponseWriter: httptest.NewRecorder()}
+		tee.Header()["Vary"] = tt.vary
+		tee.Write([]byte("body"))
+		if got := tee.shared() != nil; got != tt.want {
+			t.Errorf("Vary %q: shared = %v, want %v", tt.vary, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,709 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the settings of the load balancer
+type Config struct {
+	Port                     int
+	TLSCert                  string
+	TLSKey                   string
+	TLSMinVersion            string
+	TLSCiphers               StringList
+	TLSClientCA              string
+	ForwardClientTLS         bool
+	ForwardProxy             bool
+	ForwardProxyPorts        string
+	HTTP2                    bool
+	Autocert                 StringList
+	AutocertCache            string
+	AutocertEmail            string
+	AutocertStaging          bool
+	AutocertHTTPAddr         string
+	FlushInterval            time.Duration
+	ProxyBufferSize          int
+	ReadHeaderTimeout        time.Duration
+	MaxHeaderBytes           int
+	ReadTimeout              time.Duration
+	WriteTimeout             time.Duration
+	IdleTimeout              time.Duration
+	DisableKeepAlive         bool
+	Strategy                 string
+	AdaptiveWeights          time.Duration
+	LoadHeader               string
+	SuccessRateWindow        time.Duration
+	Coalesce                 bool
+	AccessLogSample          int
+	LocalZone                string
+	ZoneSpillover            float64
+	DialFallbackDelay        time.Duration
+	ResponseTimeout          time.Duration
+	TotalTimeout             time.Duration
+	BodyReadTimeout          time.Duration
+	EjectFailures            int
+	EjectWindow              time.Duration
+	FailureWeights           FailureWeights
+	RetryOn                  StatusCodes
+	RetryOnHeader            HeaderMatch
+	DrainHeader              HeaderMatch
+	DrainCooldown            time.Duration
+	DiscoveryInterval        time.Duration
+	RewriteLocation          bool
+	AllowedMethods           Methods
+	RetryBudget              float64
+	RetryBudgetMin           int
+	UpstreamProxy            string
+	WarmupRequests           int
+	Shadow                   string
+	SorryServer              string
+	ShadowMaxBody            int64
+	RetryBodyMax             int64
+	MaxClientRequests        int
+	MaxConcurrentRequests    int
+	QueueTimeout             time.Duration
+	QueueWaitHeader          bool
+	Allow                    StringList
+	Deny                     StringList
+	RateLimit                int
+	RateLimitWindow          time.Duration
+	LimitStore               string
+	LimitIPv4Prefix          int
+	LimitIPv6Prefix          int
+	ProxyProtocol            bool
+	ShedThreshold            int64
+	ShedPriority             int
+	PriorityHeader           string
+	SingleBackendPassthrough bool
+	TraceDecisions           bool
+	StickyCookie             string
+	StickyTTL                time.Duration
+	StickyCookiePath         string
+	StickyCookieSecure       bool
+	StickyCookieSameSite     string
+	StickyDrainGrace         time.Duration
+	CertExpiryWarning        time.Duration
+	CertExpiryFail           bool
+	WarmupPath               string
+	WarmConnections          int
+	HealthPath               string
+	HealthCheckJitter        time.Duration
+	HealthBackoffMax         time.Duration
+	BackendOrder             string
+	BackendOrderSeed         int64
+	RoundRobinStart          int
+	DirectorPlugins          StringList
+	ErrorHeaders             Headers
+	SelfAddresses            StringList
+	MaxHops                  int
+	BasePath                 string
+	ConfigFile               string
+	Strict                   bool
+	Check                    bool
+	SelfTest                 bool
+	SelfTestPath             string
+	SelfTestHost             string
+	AdminAddr                string
+	AdminUser                string
+	AdminPassword            string
+	AdminToken               string
+	Pprof                    bool
+}
+
+// cfg is the config the load balancer runs with, set by Configure
+var cfg = DefaultConfig()
+
+// StatusCodes is a set of http status codes given as a comma separated flag
+type StatusCodes map[int]bool
+
+// String returns the status codes in ascending order separated by commas
+func (c StatusCodes) String() string {
+	codes := make([]int, 0, len(c))
+	for code := range c {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	tokens := make([]string, len(codes))
+	for i, code := range codes {
+		tokens[i] = strconv.Itoa(code)
+	}
+	return strings.Join(tokens, ",")
+}
+
+// Set parses a comma separated list of status codes
+func (c *StatusCodes) Set(value string) error {
+	codes := make(StatusCodes)
+	for _, tok := range strings.Split(value, ",") {
+		if tok = strings.TrimSpace(tok); tok == "" {
+			continue
+		}
+		code, err := strconv.Atoi(tok)
+		if err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code %q", tok)
+		}
+		codes[code] = true
+	}
+	*c = codes
+	return nil
+}
+
+// Methods is a set of http methods given as a comma separated flag
+type Methods map[string]bool
+
+// String returns the methods in alphabetical order separated by commas
+func (m Methods) String() string {
+	methods := make([]string, 0, len(m))
+	for method := range m {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ",")
+}
+
+// Set parses a comma separated list of methods
+func (m *Methods) Set(value string) error {
+	methods := make(Methods)
+	for _, tok := range strings.Split(value, ",") {
+		if tok = strings.ToUpper(strings.TrimSpace(tok)); tok != "" {
+			methods[tok] = true
+		}
+	}
+	*m = methods
+	return nil
+}
+
+// StringList collects the values of a flag given several times
+type StringList []string
+
+// String returns the values separated by commas
+func (l StringList) String() string {
+	return strings.Join(l, ",")
+}
+
+// Set adds a value
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Headers are http headers given as "Name: value" flags, repeating the flag adds headers
+// and a header without a value removes it
+type Headers http.Header
+
+// String returns the headers in alphabetical order separated by commas
+func (h Headers) String() string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tokens []string
+	for _, name := range names {
+		for _, value := range h[name] {
+			tokens = append(tokens, name+": "+value)
+		}
+	}
+	return strings.Join(tokens, ",")
+}
+
+// Set parses a "Name: value" header, replacing the values of that name
+func (h Headers) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q, expected Name: value", value)
+	}
+	name := http.CanonicalHeaderKey(strings.TrimSpace(value[:i]))
+	if value = strings.TrimSpace(value[i+1:]); value == "" {
+		delete(h, name)
+		return nil
+	}
+	h[name] = []string{value}
+	return nil
+}
+
+// Apply sets the headers on the response headers of w
+func (h Headers) Apply(w http.ResponseWriter) {
+	for name, values := range h {
+		w.Header()[name] = values
+	}
+}
+
+// ApplyRequest sets the headers on req, removing those with an empty value
+func (h Headers) ApplyRequest(req *http.Request) {
+	for name, values := range h {
+		if len(values) == 0 || values[0] == "" {
+			req.Header.Del(name)
+			continue
+		}
+		req.Header[name] = values
+	}
+}
+
+// HeaderMatch matches responses by a header given as a "Name: value" flag, a header
+// without a value matches any value
+type HeaderMatch struct {
+	Name  string
+	Value string
+}
+
+// String returns the header as "Name: value"
+func (m *HeaderMatch) String() string {
+	if m.Name == "" {
+		return ""
+	}
+	return m.Name + ": " + m.Value
+}
+
+// Set parses a "Name: value" or "Name" header
+func (m *HeaderMatch) Set(value string) error {
+	name := value
+	if i := strings.Index(value, ":"); i >= 0 {
+		name, m.Value = value[:i], strings.TrimSpace(value[i+1:])
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		return fmt.Errorf("invalid header %q, expected Name: value", value)
+	}
+	m.Name = http.CanonicalHeaderKey(name)
+	return nil
+}
+
+// Matches returns true when h has the header with the value, ignoring case
+func (m *HeaderMatch) Matches(h http.Header) bool {
+	if m.Name == "" {
+		return false
+	}
+	values, ok := h[m.Name]
+	if !ok {
+		return false
+	}
+	if m.Value == "" {
+		return true
+	}
+	for _, value := range values {
+		if strings.EqualFold(strings.TrimSpace(value), m.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// BackendConfig describes a backend in the config file
+type BackendConfig struct {
+	URL         string             `json:"url"`
+	Weight      *int               `json:"weight,omitempty"`
+	Priority    int                `json:"priority,omitempty"`
+	MaxConns    int64              `json:"max_conns,omitempty"`
+	Tags        map[string]string  `json:"tags,omitempty"`
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+	Schedule    []WeightStepConfig `json:"schedule,omitempty"`
+	// RequestHeaders are set on the requests sent to the backend, an empty value removes the header
+	RequestHeaders map[string]string `json:"request_headers,omitempty"`
+}
+
+// WeightStepConfig sets the weight of a backend at the RFC 3339 time At or the
+// duration After startup, with Ramp the weight moves there linearly from the previous step
+type WeightStepConfig struct {
+	At     string `json:"at,omitempty"`
+	After  string `json:"after,omitempty"`
+	Weight int    `json:"weight"`
+	Ramp   bool   `json:"ramp,omitempty"`
+}
+
+// HealthCheckConfig describes the health check of a backend, either a "tcp" dial,
+// an "http" request to Path whose response contains Body and matches BodyPattern
+// or a combination of Checks where "all" or "any" must pass
+type HealthCheckConfig struct {
+	Type        string              `json:"type"`
+	Path        string              `json:"path,omitempty"`
+	Body        string              `json:"body,omitempty"`
+	BodyPattern string              `json:"body_pattern,omitempty"`
+	Checks      []HealthCheckConfig `json:"checks,omitempty"`
+}
+
+// PoolConfig describes a pool of backends in the config file,
+// ErrorPage is a file served while none of them is available
+type PoolConfig struct {
+	Backends  []BackendConfig `json:"backends"`
+	Strategy  string          `json:"strategy,omitempty"`
+	ErrorPage string          `json:"error_page,omitempty"`
+	// SorryServer is proxied to while none of the backends is available, -sorry-server when empty
+	SorryServer string `json:"sorry_server,omitempty"`
+	// Strategies is a chain of strategies in place of Strategy, see Chain
+	Strategies []string `json:"strategies,omitempty"`
+	// MinBackends and MaxBackends bound the size of the pool as its backends change
+	MinBackends int `json:"min_backends,omitempty"`
+	MaxBackends int `json:"max_backends,omitempty"`
+	// Spillover sends part of the traffic of a priority tier to the next one
+	Spillover map[int]TierSpillover `json:"spillover,omitempty"`
+	// SelfTestPath is the path of the -selftest requests to the pool, routed to it, -selftest-path when empty
+	SelfTestPath string `json:"selftest_path,omitempty"`
+	// SRV is a DNS SRV name, such as _http._tcp.api.service.consul, the backends are
+	// discovered from in place of Backends and looked up again every -discovery-interval
+	SRV string `json:"srv,omitempty"`
+}
+
+// RouteConfig sends requests to a pool when their path starts with Prefix
+// or matches the Pattern regex, and when given their body is at least
+// MinContentLength bytes of ContentType. Routes are evaluated in order
+type RouteConfig struct {
+	Prefix           string `json:"prefix,omitempty"`
+	Pattern          string `json:"pattern,omitempty"`
+	MinContentLength int64  `json:"min_content_length,omitempty"`
+	ContentType      string `json:"content_type,omitempty"`
+	Pool             string `json:"pool"`
+	// Timeout, MaxAttempts and RetryOn override -total-timeout, the retries and -retry-on, see RoutePolicy
+	Timeout     string `json:"timeout,omitempty"`
+	MaxAttempts int    `json:"max_attempts,omitempty"`
+	RetryOn     []int  `json:"retry_on,omitempty"`
+}
+
+// FileConfig is the content of the config file
+type FileConfig struct {
+	Pools  map[string]PoolConfig `json:"pools"`
+	Routes []RouteConfig         `json:"routes"`
+}
+
+// loadFileConfig reads the config file at path
+func loadFileConfig(path string) (*FileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var fc FileConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return &fc, nil
+}
+
+// poolNames returns the names of the configured pools in order
+func (fc *FileConfig) poolNames() []string {
+	names := make([]string, 0, len(fc.Pools))
+	for name := range fc.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateFileConfig looks for problems in fc which would not stop the load balancer
+// from starting but are likely mistakes, such as duplicate backends doubling a
+// backend's share of traffic, pools which take no traffic and unreachable backends
+func validateFileConfig(fc *FileConfig) []error {
+	var problems []error
+	var reachable []*url.URL
+	for _, name := range fc.poolNames() {
+		pc := fc.Pools[name]
+		if pc.SRV != "" {
+			// the backends are only known once looked up
+			continue
+		}
+		if len(pc.Backends) == 0 {
+			problems = append(problems, fmt.Errorf("pool %q has no backends", name))
+			continue
+		}
+
+		seen := make(map[string]bool)
+		totalWeight := 0
+		for _, bc := range pc.Backends {
+			serverUrl, err := url.Parse(bc.URL)
+			if err != nil || serverUrl.Scheme == "" || serverUrl.Host == "" {
+				problems = append(problems, fmt.Errorf("pool %q: invalid backend url %q", name, redactURLs(bc.URL)))
+				continue
+			}
+			serverUrl = withoutUserinfo(serverUrl)
+			if seen[serverUrl.String()] {
+				problems = append(problems, fmt.Errorf("pool %q: duplicate backend %s", name, serverUrl))
+				continue
+			}
+			seen[serverUrl.String()] = true
+			if isSelf(serverUrl) {
+				problems = append(problems, fmt.Errorf("pool %q: backend %s points at the load balancer itself", name, serverUrl))
+				continue
+			}
+			reachable = append(reachable, serverUrl) // dialing needs no credentials
+
+			if bc.Weight == nil {
+				totalWeight++
+			} else {
+				totalWeight += *bc.Weight
+			}
+		}
+		if totalWeight == 0 {
+			problems = append(problems, fmt.Errorf("pool %q has a total weight of zero", name))
+		}
+	}
+
+	// probe the backends concurrently so a few dead ones do not delay startup
+	unreachable := make([]error, len(reachable))
+	var wg sync.WaitGroup
+	for i, u := range reachable {
+		wg.Add(1)
+		go func(i int, u *url.URL) {
+			defer wg.Done()
+			conn, err := dialBackend(u, 2*time.Second)
+			if err != nil {
+				unreachable[i] = fmt.Errorf("backend %s is unreachable: %v", u, err)
+				return
+			}
+			conn.Close()
+		}(i, u)
+	}
+	wg.Wait()
+	for _, err := range unreachable {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	return problems
+}
+
+// orderBackends returns a copy of backends in the given order,
+// "config" keeps the config order, "sorted" sorts by url and "shuffle" shuffles with rng
+func orderBackends(backends []BackendConfig, order string, rng *rand.Rand) ([]BackendConfig, error) {
+	ordered := make([]BackendConfig, len(backends))
+	copy(ordered, backends)
+	switch order {
+	case "", "config":
+	case "sorted":
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].URL < ordered[j].URL
+		})
+	case "shuffle":
+		rng.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	default:
+		return nil, fmt.Errorf("unknown backend order %q", order)
+	}
+	return ordered, nil
+}
+
+// routePolicy parses the timeout and retry overrides of the route rc
+func routePolicy(rc RouteConfig) (RoutePolicy, error) {
+	var policy RoutePolicy
+	if rc.Timeout != "" {
+		d, err := time.ParseDuration(rc.Timeout)
+		if err != nil || d <= 0 {
+			return policy, fmt.Errorf("route to %q: invalid timeout %q", rc.Pool, rc.Timeout)
+		}
+		policy.Timeout = d
+	}
+	if rc.MaxAttempts < 0 {
+		return policy, fmt.Errorf("route to %q: negative max_attempts", rc.Pool)
+	}
+	policy.MaxAttempts = rc.MaxAttempts
+	if rc.RetryOn != nil {
+		policy.RetryOn = make(StatusCodes, len(rc.RetryOn))
+		for _, code := range rc.RetryOn {
+			if code < 100 || code > 599 {
+				return policy, fmt.Errorf("route to %q: invalid retry_on status code %d", rc.Pool, code)
+			}
+			policy.RetryOn[code] = true
+		}
+	}
+	return policy, nil
+}
+
+// buildRouter creates the pools, backends and routes described by fc
+func buildRouter(fc *FileConfig) (*Router, error) {
+	rt := NewRouter()
+	rng := rand.New(rand.NewSource(cfg.BackendOrderSeed))
+	for _, name := range fc.poolNames() {
+		pc := fc.Pools[name]
+		strategy := pc.Strategy
+		if len(pc.Strategies) > 0 {
+			if strategy != "" {
+				return nil, fmt.Errorf("pool %q has both a strategy and strategies", name)
+			}
+			strategy = strings.Join(pc.Strategies, ",")
+		}
+		if strategy == "" {
+			strategy = cfg.Strategy
+		}
+		balancer, err := newBalancer(strategy)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %v", name, err)
+		}
+
+		if cfg.LocalZone != "" {
+			balancer = &ZoneAware{Zone: cfg.LocalZone, MinAvailable: cfg.ZoneSpillover, Balancer: balancer}
+		}
+
+		backends, err := orderBackends(pc.Backends, cfg.BackendOrder, rng)
+		if err != nil {
+			return nil, err
+		}
+
+		if pc.MinBackends < 0 || pc.MaxBackends < 0 || (pc.MaxBackends > 0 && pc.MinBackends > pc.MaxBackends) {
+			return nil, fmt.Errorf("pool %q: min_backends must not exceed max_backends", name)
+		}
+		if pc.MaxBackends > 0 && len(backends) > pc.MaxBackends {
+			return nil, fmt.Errorf("pool %q has %d backends, more than its max_backends of %d", name, len(backends), pc.MaxBackends)
+		}
+
+		for priority, spill := range pc.Spillover {
+			if spill.Share < 0 || spill.Share > 1 || spill.Threshold < 0 || spill.Threshold >= 1 {
+				return nil, fmt.Errorf("pool %q: spillover of tier %d needs a share between 0 and 1 and a threshold below 1", name, priority)
+			}
+		}
+
+		if pc.SelfTestPath != "" && !strings.HasPrefix(pc.SelfTestPath, "/") {
+			return nil, fmt.Errorf("pool %q: selftest_path must start with a slash", name)
+		}
+
+		pool := NewServerPool(name, balancer)
+		pool.SelfTestPath = pc.SelfTestPath
+		pool.MinSize = pc.MinBackends
+		pool.MaxSize = pc.MaxBackends
+		pool.Spillover = pc.Spillover
+		if pc.ErrorPage != "" {
+			if pool.ErrorPage, err = loadErrorPage(pc.ErrorPage); err != nil {
+				return nil, fmt.Errorf("pool %q: %v", name, err)
+			}
+		}
+		sorryServer := pc.SorryServer
+		if sorryServer == "" {
+			sorryServer = cfg.SorryServer
+		}
+		if sorryServer != "" {
+			sorryUrl, err := parseSorryServer(sorryServer)
+			if err != nil {
+				return nil, fmt.Errorf("pool %q: %v", name, err)
+			}
+			pool.Fallback = NewSorryServer(sorryUrl)
+		}
+		for _, bc := range backends {
+			serverUrl, err := url.Parse(bc.URL)
+			if err != nil {
+				return nil, fmt.Errorf("pool %q: invalid backend url %q", name, redactURLs(bc.URL))
+			}
+			if pool.GetBackend(serverUrl) != nil {
+				logWarnf("Skipping duplicate server: %s (pool %s)\n", withoutUserinfo(serverUrl), name)
+				continue
+			}
+			if isSelf(serverUrl) {
+				logWarnf("Skipping server pointing at the load balancer itself: %s (pool %s)\n", withoutUserinfo(serverUrl), name)
+				continue
+			}
+			backend := NewBackend(serverUrl)
+			if backend.HealthChecker, err = newHealthChecker(bc.HealthCheck); err != nil {
+				return nil, fmt.Errorf("pool %q: backend %s: %v", name, backend.URL, err)
+			}
+			if bc.Weight != nil {
+				if *bc.Weight < 0 {
+					return nil, fmt.Errorf("pool %q: negative weight for %s", name, backend.URL)
+				}
+				backend.SetWeight(*bc.Weight)
+			}
+			if backend.Schedule, err = newWeightSchedule(bc.Schedule, startTime); err != nil {
+				return nil, fmt.Errorf("pool %q: backend %s: %v", name, backend.URL, err)
+			}
+			// past due steps take effect before any traffic is served
+			if weight, ok := backend.Schedule.WeightAt(time.Now()); ok {
+				backend.SetWeight(weight)
+			}
+			backend.Tags = bc.Tags
+			backend.Priority = bc.Priority
+			if bc.MaxConns < 0 {
+				return nil, fmt.Errorf("pool %q: negative max_conns for %s", name, backend.URL)
+			}
+			backend.MaxConns = bc.MaxConns
+			if len(bc.RequestHeaders) > 0 {
+				backend.RequestHeader = make(Headers, len(bc.RequestHeaders))
+				for name, value := range bc.RequestHeaders {
+					backend.RequestHeader[http.CanonicalHeaderKey(name)] = []string{value}
+				}
+			}
+			pool.AddBackend(backend)
+			logInfof("Configured server: %s (pool %s)\n", backend.URL, name)
+		}
+		if pc.SRV != "" {
+			if len(pc.Backends) > 0 {
+				return nil, fmt.Errorf("pool %q has both backends and an srv name", name)
+			}
+			pool.SRV = pc.SRV
+			if err := discoverSRV(pool); err != nil {
+				return nil, err
+			}
+		}
+		rt.AddPool(pool)
+	}
+
+	for _, rc := range fc.Routes {
+		pattern := rc.Pattern
+		body := BodyMatch{MinContentLength: rc.MinContentLength, ContentType: rc.ContentType}
+		switch {
+		case rc.Prefix != "" && pattern != "":
+			return nil, fmt.Errorf("route to %q has both a prefix and a pattern", rc.Pool)
+		case rc.Prefix != "":
+			pattern = "^" + regexp.QuoteMeta(rc.Prefix)
+		case pattern == "" && body == BodyMatch{}:
+			return nil, fmt.Errorf("route to %q needs a prefix, a pattern or a content match", rc.Pool)
+		}
+		policy, err := routePolicy(rc)
+		if err != nil {
+			return nil, err
+		}
+		if err := rt.AddRouteWithPolicy(pattern, body, rc.Pool, policy); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rt.pools) == 0 {
+		return nil, errors.New("no backends configured")
+	}
+	return rt, nil
+}
+
+// validateDurations checks the durations given on the command line are in range
+func validateDurations() error {
+	for name, d := range map[string]time.Duration{
+		"read-header-timeout": cfg.ReadHeaderTimeout,
+		"read-timeout":        cfg.ReadTimeout,
+		"write-timeout":       cfg.WriteTimeout,
+		"idle-timeout":        cfg.IdleTimeout,
+		"response-timeout":    cfg.ResponseTimeout,
+		"total-timeout":       cfg.TotalTimeout,
+		"body-read-timeout":   cfg.BodyReadTimeout,
+		"adaptive-weights":    cfg.AdaptiveWeights,
+		"sticky-drain-grace":  cfg.StickyDrainGrace,
+		"cert-expiry-warning": cfg.CertExpiryWarning,
+		"queue-timeout":       cfg.QueueTimeout,
+		"health-backoff-max":  cfg.HealthBackoffMax,
+		"success-rate-window": cfg.SuccessRateWindow,
+	} {
+		if d < 0 {
+			return fmt.Errorf("-%s must not be negative, got %s", name, d)
+		}
+	}
+	for name, d := range map[string]time.Duration{
+		"eject-window":       cfg.EjectWindow,
+		"sticky-ttl":         cfg.StickyTTL,
+		"drain-cooldown":     cfg.DrainCooldown,
+		"discovery-interval": cfg.DiscoveryInterval,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("-%s must be positive, got %s", name, d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// connectPorts are the ports CONNECT requests may tunnel to with -forward-proxy, nil allows any
+var connectPorts map[string]bool
+
+// parseConnectPorts parses the comma separated -forward-proxy-ports, * allows any port
+func parseConnectPorts(value string) (map[string]bool, error) {
+	if strings.TrimSpace(value) == "*" {
+		return nil, nil
+	}
+	ports := make(map[string]bool)
+	for _, tok := range strings.Split(value, ",") {
+		if tok = strings.TrimSpace(tok); tok == "" {
+			continue
+		}
+		if port, err := strconv.Atoi(tok); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid forward proxy port %q", tok)
+		}
+		ports[tok] = true
+	}
+	if len(ports) == 0 {
+		return nil, errors.New("please provide the forward proxy ports or * for any port")
+	}
+	return ports, nil
+}
+
+// isConnect returns true for the CONNECT requests tunneled by the forward proxy
+func isConnect(r *http.Request) bool {
+	return cfg.ForwardProxy && r.Method == http.MethodConnect
+}
+
+// tunnel serves a CONNECT request by opening a connection to the host:port it asks for,
+// through the upstream proxy if any, and copying the bytes both ways until either side
+// is done. The tunnel bypasses the pools, it is for egress rather than load balancing
+func tunnel(w http.ResponseWriter, r *http.Request) {
+	if !currentACL().Allowed(clientIP(r)) {
+		logWarnf("%s(CONNECT %s) Client denied by the ACL\n", r.RemoteAddr, r.Host)
+		httpError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil || host == "" {
+		httpError(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if connectPorts != nil && !connectPorts[port] {
+		logWarnf("%s(CONNECT %s) Port not in -forward-proxy-ports\n", r.RemoteAddr, r.Host)
+		httpError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// HTTP/2 streams cannot be taken over, nothing is dialed for them
+	if r.ProtoMajor != 1 || !canHijack(w) {
+		httpError(w, r, "HTTP version not supported", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	upstream, err := dialBackend(&url.URL{Scheme: "https", Host: r.Host}, backendDialTimeout)
+	if err != nil {
+		logWarnf("%s(CONNECT %s) Failed to connect, error: %v\n", r.RemoteAddr, r.Host, err)
+		httpError(w, r, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	client, buffered, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		upstream.Close()
+		logErrorf("%s(CONNECT %s) Failed to take over the connection, error: %v\n", r.RemoteAddr, r.Host, err)
+		httpError(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// the deadlines of the server are meant for requests, not for a tunnel
+	client.SetDeadline(time.Time{})
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	logDebugf("%s(CONNECT %s) Tunnel opened\n", r.RemoteAddr, r.Host)
+	sent, received := splice(client, buffered, upstream)
+	logDebugf("%s(CONNECT %s) Tunnel closed, %d bytes sent, %d received\n", r.RemoteAddr, r.Host, sent, received)
+}
+
+// splice copies the bytes read from client, through its reader holding what was buffered
+// already, to upstream and back until both sides are done, then closes both connections.
+// It returns the bytes sent upstream and received from it
+func splice(client net.Conn, clientReader io.Reader, upstream net.Conn) (int64, int64) {
+	sent := make(chan int64)
+	go func() {
+		n, _ := copyBuffered(upstream, clientReader)
+		closeWrite(upstream)
+		sent <- n
+	}()
+	received, _ := copyBuffered(client, upstream)
+	closeWrite(client)
+	n := <-sent
+	client.Close()
+	upstream.Close()
+	return n, received
+}
+
+// copyBuffered copies src to dst with a buffer of the proxy buffer pool
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := proxyBuffers.Get()
+	defer proxyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, buf)
+}
+
+// closeWrite tells the peer of conn that nothing more is sent, closing conn when it
+// cannot be half closed so the copy towards it ends either way
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,106 @@
+package lb
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startEcho starts a TCP server echoing back what it reads, close the listener when done
+func startEcho(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func configureForwardProxy(t *testing.T) {
+	c := DefaultConfig()
+	c.ForwardProxy = true
+	c.ForwardProxyPorts = "*"
+	if err := Configure(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	configureForwardProxy(t)
+	defer Configure(DefaultConfig())
+	echo := startEcho(t)
+	defer echo.Close()
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	io.WriteString(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Errorf("tunnel echoed %q, %v, want %q", line, err, "ping\n")
+	}
+}
+
+func TestTunnelRefusesUnhijackableWriters(t *testing.T) {
+	configureForwardProxy(t)
+	defer Configure(DefaultConfig())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tests := []struct {
+		name  string
+		major int
+		w     *httptest.ResponseRecorder
+	}{
+		{"recorder", 1, httptest.NewRecorder()},
+		{"http2", 2, httptest.NewRecorder()},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodConnect, "http://"+ln.Addr().String(), nil)
+		r.Host = ln.Addr().String()
+		r.ProtoMajor = tt.major
+		tunnel(newResponseWriter(tt.w), r)
+		if tt.w.Code != http.StatusHTTPVersionNotSupported {
+			t.Errorf("%s: status = %d, want %d", tt.name, tt.w.Code, http.StatusHTTPVersionNotSupported)
+		}
+	}
+	// neither request dialed the target
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if conn, err := ln.Accept(); err == nil {
+		conn.Close()
+		t.Error("target dialed for a connection which cannot be taken over")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,50 @@
+package lb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// decisionHeader carries the backend selection of every attempt when -trace-decisions is set
+const decisionHeader = "X-Simplelb-Decision"
+
+// explainDecision describes how peer was picked from pool, listing every candidate
+// with the state it was in, so the choice of the strategy can be followed
+func explainDecision(pool *ServerPool, peer *Backend, sticky bool, attempt int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "pool=%s strategy=%q attempt=%d", pool.Name(), balancerName(pool.Balancer()), attempt)
+	if sticky {
+		b.WriteString(" sticky")
+	}
+	if peer == nil {
+		b.WriteString(" picked=none")
+	} else {
+		fmt.Fprintf(&b, " picked=%s", peer.URL)
+	}
+
+	tier, tiered := pool.ActiveTier()
+	for _, c := range pool.Backends() {
+		fmt.Fprintf(&b, "; %s %s weight=%.2f conns=%d latency=%s", c.URL, candidateState(c, peer, tier, tiered),
+			c.EffectiveWeight(), c.ActiveConnections(), c.Latency().Round(time.Microsecond))
+	}
+	return b.String()
+}
+
+// candidateState tells why the strategy could or could not pick c, tier is the active
+// priority tier of its pool when tiered
+func candidateState(c, peer *Backend, tier int, tiered bool) string {
+	switch {
+	case c == peer:
+		return "picked"
+	case !c.IsAlive():
+		return "down"
+	case c.Draining():
+		return "draining"
+	case c.Weight() == 0:
+		return "weight-zero"
+	case tiered && c.Priority != tier:
+		return fmt.Sprintf("inactive-tier-%d", c.Priority)
+	}
+	return "available"
+}
@@ -0,0 +1,43 @@
+package lb
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+)
+
+// diagnosticsMux keeps repeated dumps from interleaving in the log
+var diagnosticsMux sync.Mutex
+
+// goroutineStacks returns the stack traces of all goroutines
+func goroutineStacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// dumpDiagnostics logs the state of every pool and backend followed by the goroutine stacks
+func dumpDiagnostics() {
+	diagnosticsMux.Lock()
+	defer diagnosticsMux.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Diagnostics dump, goroutines=%d\n", runtime.NumGoroutine())
+	for _, pool := range currentRouter().Pools() {
+		fmt.Fprintf(&buf, "pool=%s strategy=%q\n", pool.Name(), balancerName(pool.Balancer()))
+		for _, b := range pool.Backends() {
+			fmt.Fprintf(&buf, "  backend=%s alive=%t weight=%d in_flight=%d latency=%s\n",
+				b.URL, b.IsAlive(), b.Weight(), b.ActiveConnections(), b.Latency())
+		}
+	}
+	buf.WriteString("Goroutine stacks:\n")
+	buf.Write(goroutineStacks())
+	log.Print(buf.String())
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package lb
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleDiagnosticsSignal dumps the diagnostics whenever SIGUSR1 is received until ctx
+// is done, signals arriving during a dump are coalesced into the next one
+func handleDiagnosticsSignal(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-sig:
+			dumpDiagnostics()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
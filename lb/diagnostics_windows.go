@@ -0,0 +1,6 @@
+package lb
+
+import "context"
+
+// handleDiagnosticsSignal does nothing since windows has no SIGUSR1
+func handleDiagnosticsSignal(ctx context.Context) {}
@@ -0,0 +1,57 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"plugin"
+	"sync"
+)
+
+// DirectorFunc changes the request sent to a backend, such as rewriting its path or headers
+type DirectorFunc func(req *http.Request)
+
+var (
+	directorsMux sync.RWMutex
+	directors    []DirectorFunc
+)
+
+// RegisterDirector adds fn to the directors run on every request sent to a backend.
+// Directors run in the order they are registered, after the built in director has
+// pointed the request at the backend and added the backend credentials, and before
+// the reverse proxy adds the X-Forwarded-For header
+func RegisterDirector(fn DirectorFunc) {
+	directorsMux.Lock()
+	defer directorsMux.Unlock()
+	directors = append(directors, fn)
+}
+
+// runDirectors runs the registered directors on req
+func runDirectors(req *http.Request) {
+	directorsMux.RLock()
+	defer directorsMux.RUnlock()
+	for _, fn := range directors {
+		fn(req)
+	}
+}
+
+// loadDirectorPlugin registers the Director exported by the Go plugin at path,
+// a function with the signature func(*http.Request)
+func loadDirectorPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	sym, err := p.Lookup("Director")
+	if err != nil {
+		return err
+	}
+	switch fn := sym.(type) {
+	case func(*http.Request):
+		RegisterDirector(fn)
+	case *func(*http.Request):
+		RegisterDirector(*fn)
+	default:
+		return fmt.Errorf("plugin %s: Director is a %T, not a func(*http.Request)", path, sym)
+	}
+	return nil
+}
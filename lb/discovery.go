@@ -0,0 +1,158 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metadata keys of a discovered backend with a meaning of their own, the other keys
+// become tags of the backend
+const (
+	metaWeight     = "weight"
+	metaHealthPath = "health_path"
+	metaPriority   = "priority"
+)
+
+// NewDiscoveredBackend creates the backend for u described by the metadata of a
+// discovery source, such as the meta of a Consul service. A weight, health_path and
+// priority set the weight, HTTP health check path and tier of the backend, every
+// other key becomes a tag. The pool takes the weight of a backend it already has from
+// its discovered backend in SetBackends, so the discovery source keeps control of it
+func NewDiscoveredBackend(u *url.URL, meta map[string]string) (*Backend, error) {
+	b := NewBackend(u)
+	b.discovered = true
+	for key, value := range meta {
+		switch key {
+		case metaWeight:
+			weight, err := strconv.Atoi(value)
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("backend %s: invalid weight %q", b.URL, value)
+			}
+			b.SetWeight(weight)
+		case metaHealthPath:
+			if !strings.HasPrefix(value, "/") {
+				return nil, fmt.Errorf("backend %s: health path %q must start with a slash", b.URL, value)
+			}
+			b.HealthChecker = HTTPCheck{Path: value}
+		case metaPriority:
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("backend %s: invalid priority %q", b.URL, value)
+			}
+			b.Priority = priority
+		default:
+			if b.Tags == nil {
+				b.Tags = make(map[string]string)
+			}
+			b.Tags[key] = value
+		}
+	}
+	return b, nil
+}
+
+// MetaFromTags turns "key=value" tags, such as those of a Consul service, into metadata
+// for NewDiscoveredBackend, a tag without a value is kept as "true"
+func MetaFromTags(tags []string) map[string]string {
+	meta := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		if i := strings.Index(tag, "="); i > 0 {
+			meta[tag[:i]] = tag[i+1:]
+		} else if tag != "" {
+			meta[tag] = "true"
+		}
+	}
+	return meta
+}
+
+// BackendsFromSRV creates the backends of the SRV records as returned by net.LookupSRV,
+// reached over scheme. The priority of a record is the tier of its backend and its
+// weight the weight of the backend, a weight of 0 becomes 1 since it would take the
+// backend out of rotation
+func BackendsFromSRV(scheme string, records []*net.SRV) ([]*Backend, error) {
+	backends := make([]*Backend, 0, len(records))
+	for _, srv := range records {
+		weight := int(srv.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		u := &url.URL{Scheme: scheme, Host: net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))}
+		b, err := NewDiscoveredBackend(u, map[string]string{
+			metaWeight:   strconv.Itoa(weight),
+			metaPriority: strconv.Itoa(int(srv.Priority)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
+
+// sameDiscovery returns true when the discovered backend d only differs from b in
+// state the pool can update in place, such as the weight
+func sameDiscovery(b, d *Backend) bool {
+	return b.Priority == d.Priority && reflect.DeepEqual(b.Tags, d.Tags) &&
+		reflect.DeepEqual(b.HealthChecker, d.HealthChecker)
+}
+
+// lookupSRV looks up the SRV records of a name, net.LookupSRV unless replaced in tests
+var lookupSRV = net.LookupSRV
+
+// srvScheme returns the scheme the backends of the SRV name are reached over, https for
+// the _https service and http otherwise
+func srvScheme(name string) string {
+	if strings.HasPrefix(name, "_https.") {
+		return "https"
+	}
+	return "http"
+}
+
+// discoverSRV sets the backends of pool to those of the SRV records of its SRV name,
+// keeping the current backends when the lookup fails
+func discoverSRV(pool *ServerPool) error {
+	_, records, err := lookupSRV("", "", pool.SRV)
+	if err != nil {
+		return fmt.Errorf("pool %q: looking up %s: %v", pool.Name(), pool.SRV, err)
+	}
+	// the records come shuffled within a priority, the backends keep a stable order
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Target != records[j].Target {
+			return records[i].Target < records[j].Target
+		}
+		return records[i].Port < records[j].Port
+	})
+	backends, err := BackendsFromSRV(srvScheme(pool.SRV), records)
+	if err != nil {
+		return fmt.Errorf("pool %q: %v", pool.Name(), err)
+	}
+	return pool.SetBackends(backends)
+}
+
+// runDiscovery looks up the backends of the pools with an SRV name again every interval
+// until ctx is done
+func runDiscovery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for _, pool := range currentRouter().Pools() {
+				if pool.SRV == "" {
+					continue
+				}
+				if err := discoverSRV(pool); err != nil {
+					logWarnf("Discovery failed, keeping the current backends: %v\n", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
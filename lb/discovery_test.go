@@ -0,0 +1,124 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// stubSRV answers the SRV lookups with the records returned by answer until the
+// returned func restores the lookup
+func stubSRV(answer func(name string) ([]*net.SRV, error)) func() {
+	lookup := lookupSRV
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		records, err := answer(name)
+		return name, records, err
+	}
+	return func() { lookupSRV = lookup }
+}
+
+func backendURLs(pool *ServerPool) []string {
+	var urls []string
+	for _, b := range pool.Backends() {
+		urls = append(urls, b.URL.String())
+	}
+	return urls
+}
+
+func TestDiscoverSRV(t *testing.T) {
+	defer Configure(DefaultConfig())
+	if err := Configure(DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	records := []*net.SRV{
+		{Target: "b.example.", Port: 8080, Priority: 1, Weight: 5},
+		{Target: "a.example.", Port: 8080, Priority: 0, Weight: 0},
+	}
+	var lookupErr error
+	defer stubSRV(func(name string) ([]*net.SRV, error) {
+		if name != "_https._tcp.api.example" {
+			t.Errorf("looked up %q", name)
+		}
+		return records, lookupErr
+	})()
+
+	rt, err := buildRouter(&FileConfig{Pools: map[string]PoolConfig{
+		"api": {SRV: "_https._tcp.api.example"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := rt.Pools()[0]
+	want := []string{"https://a.example:8080", "https://b.example:8080"}
+	if got := backendURLs(pool); !reflect.DeepEqual(got, want) {
+		t.Fatalf("backends = %v, want %v", got, want)
+	}
+	if b := pool.Backends()[1]; b.Weight() != 5 || b.Priority != 1 {
+		t.Errorf("%s has weight %d and priority %d, want 5 and 1", b.URL, b.Weight(), b.Priority)
+	}
+
+	records = []*net.SRV{{Target: "a.example.", Port: 8080}}
+	if err := discoverSRV(pool); err != nil {
+		t.Fatal(err)
+	}
+	if got := backendURLs(pool); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("backends after a record went away = %v, want %v", got, want[:1])
+	}
+
+	lookupErr = errors.New("no such host")
+	if err := discoverSRV(pool); err == nil {
+		t.Error("failed lookup returned no error")
+	}
+	if got := backendURLs(pool); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("backends after a failed lookup = %v, want %v kept", got, want[:1])
+	}
+}
+
+func TestDiscoverSRVKeepsMinBackends(t *testing.T) {
+	defer Configure(DefaultConfig())
+	if err := Configure(DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	records := []*net.SRV{{Target: "a.example.", Port: 80}, {Target: "b.example.", Port: 80}}
+	defer stubSRV(func(string) ([]*net.SRV, error) { return records, nil })()
+
+	rt, err := buildRouter(&FileConfig{Pools: map[string]PoolConfig{
+		"api": {SRV: "_http._tcp.api.example", MinBackends: 2},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := rt.Pools()[0]
+
+	records = records[:1]
+	if err := discoverSRV(pool); err == nil {
+		t.Error("shrinking below min_backends returned no error")
+	}
+	if got := len(pool.Backends()); got != 2 {
+		t.Errorf("pool has %d backends, want the 2 last discovered kept", got)
+	}
+}
+
+func TestPoolWithBackendsAndSRV(t *testing.T) {
+	defer Configure(DefaultConfig())
+	if err := Configure(DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	defer stubSRV(func(string) ([]*net.SRV, error) { return nil, nil })()
+
+	_, err := buildRouter(&FileConfig{Pools: map[string]PoolConfig{
+		"api": {SRV: "_http._tcp.api.example", Backends: []BackendConfig{{URL: "http://a.example"}}},
+	}})
+	if err == nil {
+		t.Error("pool with both backends and an srv name built")
+	}
+}
+
+func TestMetaFromTags(t *testing.T) {
+	got := MetaFromTags([]string{"weight=3", "canary", "zone=eu=1", ""})
+	want := map[string]string{"weight": "3", "canary": "true", "zone": "eu=1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MetaFromTags = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+package lb
+
+import (
+	"net/http"
+	"time"
+)
+
+// observeDrainHeader starts draining b for -drain-cooldown when response carries the
+// -drain-header, a backend about to shut down asking for no new requests. The header
+// is a signal to the load balancer and is not passed on to the client
+func observeDrainHeader(b *Backend, response *http.Response) {
+	if !cfg.DrainHeader.Matches(response.Header) {
+		return
+	}
+	response.Header.Del(cfg.DrainHeader.Name)
+	if !b.drainFor(cfg.DrainCooldown) {
+		return
+	}
+	logInfof("Draining server: %s (pool %s) for %s on its %s header\n", b.URL, b.Pool(), cfg.DrainCooldown, cfg.DrainHeader.Name)
+	publishBackendEvent(EventDrain, b, "drain header")
+	afterBackground(cfg.DrainCooldown, func() { endDrainCooldown(b) })
+}
+
+// drainFor starts draining this backend until cooldown from now, or extends the drain it
+// asked for earlier, returning true when it was not draining yet. Backends drained by
+// an operator stay drained
+func (b *Backend) drainFor(cooldown time.Duration) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	now := time.Now()
+	if !b.drainStart.IsZero() {
+		if !b.drainUntil.IsZero() {
+			b.drainUntil = now.Add(cooldown)
+		}
+		return false
+	}
+	b.drainStart = now
+	b.drainUntil = now.Add(cooldown)
+	return true
+}
+
+// endDrainCooldown stops draining b once the cooldown it asked for is over, checking
+// again later when it asked for more in the meantime
+func endDrainCooldown(b *Backend) {
+	b.mux.Lock()
+	if b.drainUntil.IsZero() {
+		// undrained or taken over by an operator
+		b.mux.Unlock()
+		return
+	}
+	if left := time.Until(b.drainUntil); left > 0 {
+		b.mux.Unlock()
+		afterBackground(left, func() { endDrainCooldown(b) })
+		return
+	}
+	b.drainStart = time.Time{}
+	b.drainUntil = time.Time{}
+	b.mux.Unlock()
+
+	logInfof("Stopped draining server: %s (pool %s), its drain cooldown is over\n", b.URL, b.Pool())
+	publishBackendEvent(EventUndrain, b, "drain cooldown over")
+}
+
+// DrainUntil returns when the drain this backend asked for with -drain-header ends,
+// zero unless it is draining on its own request
+func (b *Backend) DrainUntil() time.Time {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.drainUntil
+}
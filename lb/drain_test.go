@@ -0,0 +1,66 @@
+package lb
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// drainResponse returns a backend response asking to be drained with the drain header of c
+func drainResponse(c Config) *http.Response {
+	header := make(http.Header)
+	header.Set(c.DrainHeader.Name, c.DrainHeader.Value)
+	return &http.Response{StatusCode: http.StatusOK, Header: header}
+}
+
+func drainConfig(t *testing.T) Config {
+	c := DefaultConfig()
+	if err := c.DrainHeader.Set("X-Drain: true"); err != nil {
+		t.Fatal(err)
+	}
+	c.DrainCooldown = 20 * time.Millisecond
+	return c
+}
+
+func TestDrainCooldownEnds(t *testing.T) {
+	c := drainConfig(t)
+	b := testBackends(t, 1)[0]
+	if err := Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(DefaultConfig())
+	defer Stop()
+
+	response := drainResponse(c)
+	observeDrainHeader(b, response)
+	if !b.Draining() {
+		t.Fatal("backend asking for it not drained")
+	}
+	if response.Header.Get("X-Drain") != "" {
+		t.Error("drain header passed on to the client")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if b.Draining() {
+		t.Error("backend still draining after its cooldown")
+	}
+}
+
+func TestStopCancelsDrainCooldown(t *testing.T) {
+	c := drainConfig(t)
+	b := testBackends(t, 1)[0]
+	if err := Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(DefaultConfig())
+
+	observeDrainHeader(b, drainResponse(c))
+	Stop()
+	if n := len(lifecycle.timers); n != 0 {
+		t.Errorf("%d timers pending after Stop", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// the cooldown timer was stopped along with the load balancer
+	if !b.Draining() {
+		t.Error("drain cooldown ended after Stop")
+	}
+}
@@ -0,0 +1,39 @@
+package lb
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+// ErrorPage is served in place of the plain error when a pool has no available backend
+type ErrorPage struct {
+	Body        []byte
+	ContentType string
+}
+
+// loadErrorPage reads the error page at path, typed by its extension or else its content
+func loadErrorPage(path string) (*ErrorPage, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return &ErrorPage{Body: body, ContentType: contentType}, nil
+}
+
+// ServeHTTP writes the page with a 503 status
+func (p *ErrorPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg.ErrorHeaders.Apply(w)
+	w.Header().Set("Content-Type", p.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(p.Body)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method != http.MethodHead {
+		w.Write(p.Body)
+	}
+}
@@ -0,0 +1,143 @@
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// categories of errors returned when talking to a backend
+const (
+	ErrorCanceled = "canceled"
+	ErrorRefused  = "connection_refused"
+	ErrorReset    = "connection_reset"
+	ErrorTimeout  = "timeout"
+	ErrorDNS      = "dns"
+	ErrorTLS      = "tls"
+	ErrorStatus   = "status"
+	ErrorOverload = "overloaded"
+	ErrorOther    = "other"
+)
+
+// errorCategories are the categories a backend error is classified into
+var errorCategories = []string{ErrorCanceled, ErrorRefused, ErrorReset, ErrorTimeout, ErrorDNS, ErrorTLS, ErrorStatus, ErrorOverload, ErrorOther}
+
+// statusError is returned for backend responses with a status code configured to retry on
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("backend responded with status %d", e.code)
+}
+
+// overloadError is returned for backend responses carrying the -retry-on-header header
+type overloadError struct {
+	header string
+}
+
+func (e *overloadError) Error() string {
+	return fmt.Sprintf("backend responded with overload header %s", e.header)
+}
+
+// classifyError derives the category of an error returned by a backend
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	var statusErr *statusError
+	var overloadErr *overloadError
+
+	switch {
+	case errors.As(err, &statusErr):
+		return ErrorStatus
+	case errors.As(err, &overloadErr):
+		return ErrorOverload
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return ErrorReset
+	case errors.As(err, &recordErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr),
+		strings.Contains(err.Error(), "tls: "):
+		return ErrorTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	}
+	return ErrorOther
+}
+
+// jsonError is the body of the errors sent to clients preferring JSON
+type jsonError struct {
+	Error     string `json:"error"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// httpError replies with an error generated by the load balancer itself,
+// carrying the -error-header headers. Clients preferring JSON get a jsonError
+func httpError(w http.ResponseWriter, r *http.Request, error string, code int) {
+	cfg.ErrorHeaders.Apply(w)
+	if !prefersJSON(r) {
+		http.Error(w, error, code)
+		return
+	}
+	body, _ := json.Marshal(jsonError{Error: error, Status: code, RequestID: r.Header.Get("X-Request-Id")})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(append(body, '\n'))
+}
+
+// prefersJSON returns true when the Accept header of r ranks JSON above plain text and
+// HTML, the one listed first wins a tie
+func prefersJSON(r *http.Request) bool {
+	jsonQ, textQ := 0.0, 0.0
+	jsonAt, textAt := 0, 0
+	i := 0
+	for _, header := range r.Header["Accept"] {
+		for _, accepted := range strings.Split(header, ",") {
+			i++
+			mediaType, params, err := mime.ParseMediaType(accepted)
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if value, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(value, 64); err != nil {
+					continue
+				}
+			}
+			switch {
+			case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+				if q > jsonQ {
+					jsonQ, jsonAt = q, i
+				}
+			case mediaType == "text/html" || mediaType == "text/plain" || mediaType == "text/*":
+				if q > textQ {
+					textQ, textAt = q, i
+				}
+			}
+		}
+	}
+	return jsonQ > textQ || (jsonQ > 0 && jsonQ == textQ && jsonAt < textAt)
+}
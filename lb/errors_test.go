@@ -0,0 +1,82 @@
+package lb
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startGarbage starts a TCP server answering every connection with a line which is not HTTP
+func startGarbage(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("SSH-2.0-OpenSSH_8.9\r\n"))
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func TestGarbageBackendIsEjected(t *testing.T) {
+	garbage := startGarbage(t)
+	defer garbage.Close()
+	c := DefaultConfig()
+	c.EjectFailures = 1
+	server, pool := serveBackends(t, c, "http://"+garbage.Addr().String())
+	defer server.Close()
+	defer Configure(DefaultConfig())
+	b := pool.Backends()[0]
+	failures := backendErrors.WithLabelValues(backendLabelValues(b, ErrorOther)...)
+	before := testutil.ToFloat64(failures)
+
+	resp, err := server.Client().Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway && resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want a 502 or 503", resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(failures) - before; got < 1 {
+		t.Errorf("%s errors counted %v, want at least 1", ErrorOther, got)
+	}
+	if b.IsAlive() {
+		t.Error("backend answering garbage is still alive")
+	}
+	if msg, _ := b.LastError(); msg == "" {
+		t.Error("no last error recorded for the backend")
+	}
+}
+
+func TestErrorHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "Cache-Control: no-store"},
+		{[]string{"-error-header", "Cache-Control:"}, ""},
+		{[]string{"-error-header", "Cache-Control: no-cache", "-error-header", "Retry-After: 5"}, "Cache-Control: no-cache,Retry-After: 5"},
+	} {
+		var c Config
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		RegisterFlags(fs, &c)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ErrorHeaders.String(); got != tc.want {
+			t.Errorf("%v: error headers = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
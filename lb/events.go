@@ -0,0 +1,99 @@
+package lb
+
+import (
+	"sync"
+	"time"
+)
+
+// eventBuffer is the number of events a subscriber may fall behind before
+// further events are dropped for it
+const eventBuffer = 64
+
+// types of backend events
+const (
+	EventUp      = "up"
+	EventDown    = "down"
+	EventEject   = "eject"
+	EventWeight  = "weight"
+	EventDrain   = "drain"
+	EventUndrain = "undrain"
+	EventAdded   = "added"
+	EventRemoved = "removed"
+)
+
+// Event is a change of the state of a backend
+type Event struct {
+	Type    string    `json:"type"`
+	Pool    string    `json:"pool"`
+	Backend string    `json:"backend"`
+	Weight  *int      `json:"weight,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// EventBus hands the backend events to every subscriber
+type EventBus struct {
+	mux         sync.Mutex
+	subscribers map[chan Event]bool
+	closed      bool
+}
+
+// NewEventBus creates a bus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]bool)}
+}
+
+// Subscribe returns a channel receiving the events published from now on and a
+// function to unsubscribe, the channel is closed once the bus is closed
+func (bus *EventBus) Subscribe() (<-chan Event, func()) {
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+	ch := make(chan Event, eventBuffer)
+	if bus.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	bus.subscribers[ch] = true
+	return ch, func() {
+		bus.mux.Lock()
+		defer bus.mux.Unlock()
+		if bus.subscribers[ch] {
+			delete(bus.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish sends e to the subscribers, dropping it for those too far behind
+// so a slow subscriber never blocks the load balancer
+func (bus *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+	for ch := range bus.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Close ends every subscription
+func (bus *EventBus) Close() {
+	bus.mux.Lock()
+	defer bus.mux.Unlock()
+	for ch := range bus.subscribers {
+		delete(bus.subscribers, ch)
+		close(ch)
+	}
+	bus.closed = true
+}
+
+// publishBackendEvent publishes an event of the given type for b
+func publishBackendEvent(eventType string, b *Backend, reason string) {
+	events.Publish(Event{Type: eventType, Pool: b.Pool(), Backend: b.URL.String(), Reason: reason})
+}
+
+var events = NewEventBus()
@@ -0,0 +1,148 @@
+package lb_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kasvith/simplelb/lb"
+	"github.com/kasvith/simplelb/lb/lbtest"
+)
+
+func TestRetryOnStatusFailsOverAndPassesTheLastResponse(t *testing.T) {
+	backends := []*lbtest.Backend{lbtest.NewBackend(), lbtest.NewBackend(), lbtest.NewBackend()}
+	for _, b := range backends {
+		defer b.Close()
+		b.SetStatus(http.StatusServiceUnavailable)
+	}
+
+	c := lb.DefaultConfig()
+	c.RetryOn = lb.StatusCodes{http.StatusServiceUnavailable: true}
+	l, err := lbtest.Start(c, &lb.RoundRobin{}, backends...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	resp, err := l.Client().Get(l.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want the backend 503 passed on", resp.StatusCode)
+	}
+	if string(body) != backends[2].URL {
+		t.Errorf("body = %q, want the response of the last backend tried %s", body, backends[2].URL)
+	}
+	// each attempt fails over to the next backend, none is retried
+	for _, b := range backends {
+		if b.Hits() != 1 {
+			t.Errorf("%s got %d requests, want 1", b.URL, b.Hits())
+		}
+	}
+	for _, b := range l.Pool.Backends() {
+		if !b.IsAlive() {
+			t.Errorf("%s marked down for answering with a status to retry on", b.URL)
+		}
+	}
+}
+
+func TestUnreadBodyFailsOver(t *testing.T) {
+	dead, live := lbtest.NewBackend(), lbtest.NewBackend()
+	defer live.Close()
+	c := lb.DefaultConfig()
+	l, err := lbtest.Start(c, &lb.RoundRobin{}, dead, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the connection to a closed backend is refused before any of the body is read
+	dead.Close()
+
+	resp, err := l.Client().Post(l.URL+"/", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := string(live.LastBody()); got != "payload" {
+		t.Errorf("live backend got body %q, want %q", got, "payload")
+	}
+}
+
+func TestStaleKeepAliveConnection(t *testing.T) {
+	backend := lbtest.NewBackend()
+	defer backend.Close()
+	l, err := lbtest.Start(lb.DefaultConfig(), &lb.RoundRobin{}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := l.Get("/", 1); err != nil {
+		t.Fatal(err)
+	}
+	// the backend drops the keep-alive connection pooled by the load balancer
+	backend.CloseClientConnections()
+
+	statuses, err := l.Get("/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[http.StatusOK] != 1 {
+		t.Errorf("statuses = %v, want a 200 over a new connection", statuses)
+	}
+	if b := l.Pool.Backends()[0]; !b.IsAlive() {
+		t.Errorf("%s marked down for closing an idle connection", b.URL)
+	}
+}
+
+func TestFailoverChargesOnlyTheServingBackend(t *testing.T) {
+	failing, serving := lbtest.NewBackend(), lbtest.NewBackend()
+	defer failing.Close()
+	defer serving.Close()
+	failing.SetStatus(http.StatusServiceUnavailable)
+	serving.SetLatency(300 * time.Millisecond)
+
+	c := lb.DefaultConfig()
+	c.RetryOn = lb.StatusCodes{http.StatusServiceUnavailable: true}
+	l, err := lbtest.Start(c, &lb.RoundRobin{}, failing, serving)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	backends := l.Pool.Backends()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Get("/", 1)
+		done <- err
+	}()
+	for serving.Hits() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := backends[0].ActiveConnections(); n != 0 {
+		t.Errorf("failing backend counts %d connections while another serves its request, want 0", n)
+	}
+	if n := backends[1].ActiveConnections(); n != 1 {
+		t.Errorf("serving backend counts %d connections, want 1", n)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if d := backends[0].Latency(); d != 0 {
+		t.Errorf("failing backend latency = %s, want none for a response it did not serve", d)
+	}
+	if d := backends[1].Latency(); d < 300*time.Millisecond {
+		t.Errorf("serving backend latency = %s, want at least its 300ms delay", d)
+	}
+}
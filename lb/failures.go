@@ -0,0 +1,138 @@
+package lb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedFailures bounds the failures kept by a FailureWindow
+const maxTrackedFailures = 1024
+
+// failure is a failed request of a backend weighted by its kind
+type failure struct {
+	at     time.Time
+	weight float64
+}
+
+// FailureWindow keeps the latest failures of a backend, so it can be ejected as
+// soon as it fails too often instead of waiting for the next health check
+type FailureWindow struct {
+	mux      sync.Mutex
+	failures []failure // oldest first
+}
+
+// NewFailureWindow creates a window without failures
+func NewFailureWindow() *FailureWindow {
+	return &FailureWindow{}
+}
+
+// prune forgets the failures older than window before now
+func (w *FailureWindow) prune(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(w.failures) && now.Sub(w.failures[i].at) > window {
+		i++
+	}
+	if len(w.failures)-i > maxTrackedFailures {
+		i = len(w.failures) - maxTrackedFailures
+	}
+	w.failures = w.failures[i:]
+}
+
+// score sums the weights of the failures
+func (w *FailureWindow) score() float64 {
+	var score float64
+	for _, f := range w.failures {
+		score += f.weight
+	}
+	return score
+}
+
+// Record adds a failure of the given weight at now, returning the score of the
+// failures within window of it
+func (w *FailureWindow) Record(now time.Time, window time.Duration, weight float64) float64 {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.failures = append(w.failures, failure{at: now, weight: weight})
+	w.prune(now, window)
+	return w.score()
+}
+
+// Score returns the score of the failures within window before now
+func (w *FailureWindow) Score(now time.Time, window time.Duration) float64 {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.prune(now, window)
+	return w.score()
+}
+
+// Reset forgets the failures
+func (w *FailureWindow) Reset() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.failures = nil
+}
+
+// FailureWeights are the weights of failures by error category given as a comma
+// separated flag of category=weight, categories not given weigh 1
+type FailureWeights map[string]float64
+
+// Weight returns the weight of a failure of the category
+func (fw FailureWeights) Weight(category string) float64 {
+	if weight, ok := fw[category]; ok {
+		return weight
+	}
+	return 1
+}
+
+// String returns the weights ordered by category separated by commas
+func (fw FailureWeights) String() string {
+	categories := make([]string, 0, len(fw))
+	for category := range fw {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	tokens := make([]string, len(categories))
+	for i, category := range categories {
+		tokens[i] = category + "=" + strconv.FormatFloat(fw[category], 'g', -1, 64)
+	}
+	return strings.Join(tokens, ",")
+}
+
+// Set parses a comma separated list of category=weight
+func (fw *FailureWeights) Set(value string) error {
+	weights := make(FailureWeights)
+	for _, tok := range strings.Split(value, ",") {
+		if tok = strings.TrimSpace(tok); tok == "" {
+			continue
+		}
+		i := strings.Index(tok, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid failure weight %q, expected category=weight", tok)
+		}
+		if !isErrorCategory(tok[:i]) {
+			return fmt.Errorf("unknown error category %q, expected one of %s", tok[:i], strings.Join(errorCategories, ", "))
+		}
+		weight, err := strconv.ParseFloat(tok[i+1:], 64)
+		if err != nil || weight < 0 {
+			return fmt.Errorf("invalid failure weight %q", tok)
+		}
+		weights[tok[:i]] = weight
+	}
+	*fw = weights
+	return nil
+}
+
+// isErrorCategory returns true for the known error categories
+func isErrorCategory(category string) bool {
+	for _, c := range errorCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
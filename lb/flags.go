@@ -0,0 +1,125 @@
+package lb
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RegisterFlags defines the command line flags of the load balancer on fs, storing
+// them in c, which takes their defaults
+func RegisterFlags(fs *flag.FlagSet, c *Config) {
+	// intermediaries must not keep serving an outage page once the backends recovered
+	c.ErrorHeaders = Headers{"Cache-Control": {"no-store"}}
+	fs.IntVar(&c.AccessLogSample, "access-log-sample", 0, "Log 1 in this many successful requests to the access log along with every error and retry, 1 logs all, zero disables the access log")
+	fs.BoolVar(&c.Coalesce, "coalesce", false, "Share one backend response between identical GET and HEAD requests in flight at once, when it is cacheable")
+	fs.DurationVar(&c.SuccessRateWindow, "success-rate-window", 0, "Window the success rate of a backend is counted over, lowering its effective weight as it returns errors, zero disables it")
+	fs.StringVar(&c.LoadHeader, "load-header", "", "Response header in which backends report their load from 0 to 1, lowering their effective weight, ignored when empty")
+	fs.DurationVar(&c.AdaptiveWeights, "adaptive-weights", 0, "Interval to lower the weights of backends slower than their peers, zero disables it")
+	fs.StringVar(&c.LocalZone, "local-zone", "", "Zone of the load balancer, backends tagged with the same zone are preferred")
+	fs.Float64Var(&c.ZoneSpillover, "zone-spillover", 0, "Spill over to other zones when fewer than this fraction of the local zone backends are available")
+	fs.StringVar(&c.StickyCookie, "sticky-cookie", "", "Cookie pinning a client to the backend which served it, sticky sessions are disabled when empty")
+	fs.DurationVar(&c.StickyTTL, "sticky-ttl", time.Hour, "Lifetime of the sticky cookie")
+	fs.StringVar(&c.StickyCookiePath, "sticky-cookie-path", "/", "Path attribute of the sticky cookie")
+	fs.BoolVar(&c.StickyCookieSecure, "sticky-cookie-secure", false, "Mark the sticky cookie Secure so it is only sent over HTTPS")
+	fs.StringVar(&c.StickyCookieSameSite, "sticky-cookie-samesite", "", "SameSite attribute of the sticky cookie, one of lax, strict, none, left out when empty")
+	fs.DurationVar(&c.StickyDrainGrace, "sticky-drain-grace", 0, "Duration clients pinned to a draining backend keep reaching it, -sticky-ttl when zero")
+	fs.BoolVar(&c.TraceDecisions, "trace-decisions", false, "Log the backend selection of every request at debug level and send it in the "+decisionHeader+" response header")
+	fs.BoolVar(&c.SingleBackendPassthrough, "single-backend-passthrough", false, "Send every request of a pool with a single backend to it, even while it fails health checks")
+	fs.Int64Var(&c.ShedThreshold, "shed-threshold", 0, "Requests in flight above which low priority requests are rejected, zero disables shedding")
+	fs.IntVar(&c.ShedPriority, "shed-priority", 1, "Lowest priority still served while shedding")
+	fs.StringVar(&c.PriorityHeader, "priority-header", "X-Priority", "Request header holding the integer priority of a request, missing means 0")
+	fs.DurationVar(&c.CertExpiryWarning, "cert-expiry-warning", 14*24*time.Hour, "Warn when the certificate of an https backend expires within this duration")
+	fs.BoolVar(&c.CertExpiryFail, "cert-expiry-fail", false, "Fail the health check of https backends whose certificate expires within -cert-expiry-warning")
+	fs.BoolVar(&c.ProxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol v1 or v2 header on every client connection")
+	fs.IntVar(&c.EjectFailures, "eject-failures", 0, "Score of failed requests within -eject-window which marks a backend down before its next health check, zero disables it")
+	fs.Var(&c.FailureWeights, "failure-weights", "Weights of failures towards -eject-failures by category such as timeout=0.5,connection_refused=1, use commas to separate, others weigh 1")
+	fs.DurationVar(&c.EjectWindow, "eject-window", 10*time.Second, "Window the failures of a backend are counted over for -eject-failures")
+	fs.DurationVar(&c.BodyReadTimeout, "body-read-timeout", 0, "Maximum duration a client may stall while sending its request body before it gets a 408, zero waits for -read-timeout")
+	fs.DurationVar(&c.TotalTimeout, "total-timeout", 0, "Maximum duration to serve a request including every retry and failover, zero waits forever")
+	fs.DurationVar(&c.DialFallbackDelay, "dial-fallback-delay", 300*time.Millisecond, "Delay before racing the other address family when dialing dual stack backends, negative disables the fallback")
+	fs.DurationVar(&c.ResponseTimeout, "response-timeout", 0, "Maximum duration to wait for the response headers of a backend, zero waits forever")
+	fs.Float64Var(&c.RetryBudget, "retry-budget", 0.2, "Fraction of the requests over the last 10s which may be retried, negative disables the budget")
+	fs.IntVar(&c.RetryBudgetMin, "retry-budget-min", 10, "Retries allowed over the last 10s regardless of the retry budget")
+	fs.Var(&c.AllowedMethods, "allowed-methods", "HTTP methods passed to the backends, use commas to separate, all when empty")
+	fs.BoolVar(&c.RewriteLocation, "rewrite-location", false, "Rewrite redirect locations pointing at a backend to the address the client used")
+	fs.Var(&c.DrainHeader, "drain-header", "Backend response header \"Name: value\" with which a backend shutting down asks to be drained for -drain-cooldown")
+	fs.DurationVar(&c.DrainCooldown, "drain-cooldown", 30*time.Second, "Duration a backend asking to be drained with -drain-header is drained for")
+	fs.DurationVar(&c.DiscoveryInterval, "discovery-interval", 30*time.Second, "How often the DNS SRV records of pools discovering their backends are looked up again")
+	fs.Var(&c.RetryOnHeader, "retry-on-header", "Backend response header \"Name: value\" marking the backend overloaded, the request is retried on another backend and counts towards -eject-failures")
+	fs.Int64Var(&c.RetryBodyMax, "retry-body-max", 0, "Largest body in bytes of an idempotent request buffered so it can be retried, larger bodies and those of other requests are only retried when no backend read them, zero disables buffering")
+	fs.Var(&c.RetryOn, "retry-on", "Backend response status codes to retry on another backend, use commas to separate")
+	fs.StringVar(&c.UpstreamProxy, "upstream-proxy", "", "HTTP or SOCKS5 proxy to reach the backends through, defaults to HTTP_PROXY style environment variables")
+	fs.IntVar(&c.WarmupRequests, "warmup-requests", 0, "Number of warm up requests sent to a recovered backend before it takes traffic")
+	fs.DurationVar(&c.HealthBackoffMax, "health-backoff-max", 0, "Back off the health checks of a dead backend exponentially from the 2m interval up to this duration, zero checks it every round")
+	fs.DurationVar(&c.HealthCheckJitter, "health-check-jitter", 0, "Spread the health checks of the backends over this duration by a random delay each, below the 2m health check interval")
+	fs.StringVar(&c.HealthPath, "health-path", "", "Path of the HTTP health check of backends without their own, TCP checks are used when empty")
+	fs.IntVar(&c.WarmConnections, "warm-connections", 0, "Idle connections opened to every backend at startup, when added and when it recovers, zero disables it")
+	fs.StringVar(&c.WarmupPath, "warmup-path", "/", "Path of the warm up requests")
+	fs.StringVar(&c.BackendOrder, "backend-order", "config", "Order of the backends in a pool, one of config, sorted, shuffle")
+	fs.Int64Var(&c.BackendOrderSeed, "backend-order-seed", 0, "Seed to shuffle the backends with, random when zero")
+	fs.IntVar(&c.RoundRobinStart, "round-robin-start", 0, "Index of the backend round robin starts with, wrapped by the number of backends")
+	fs.StringVar(&c.SorryServer, "sorry-server", "", "Backend serving the requests of pools without an available backend, such as a maintenance page, never health checked")
+	fs.StringVar(&c.Shadow, "shadow", "", "Shadow backend receiving a copy of every request, its responses are discarded")
+	fs.IntVar(&c.MaxConcurrentRequests, "max-concurrent-requests", 0, "Maximum requests sent to the backends at once, others are queued for -queue-timeout, zero allows any")
+	fs.DurationVar(&c.QueueTimeout, "queue-timeout", 10*time.Second, "Maximum duration a request waits for a free slot of -max-concurrent-requests before it is rejected")
+	fs.BoolVar(&c.QueueWaitHeader, "queue-wait-header", false, "Send the time a request was queued by -max-concurrent-requests in the "+queueWaitHeader+" response header")
+	fs.IntVar(&c.MaxClientRequests, "max-client-requests", 0, "Maximum concurrent requests per client ip, zero allows any")
+	fs.IntVar(&c.RateLimit, "rate-limit", 0, "Maximum requests per client ip within -rate-limit-window, zero allows any")
+	fs.DurationVar(&c.RateLimitWindow, "rate-limit-window", time.Second, "Window the rate limit of clients is counted over")
+	fs.StringVar(&c.LimitStore, "limit-store", "memory", "Store of the client limit counters, memory or a redis://[:password@]host:port[/db] url shared by several load balancers")
+	fs.IntVar(&c.LimitIPv4Prefix, "limit-ipv4-prefix", 32, "Prefix length of the IPv4 subnets sharing the client limits, 24 limits a /24 like a single client")
+	fs.IntVar(&c.LimitIPv6Prefix, "limit-ipv6-prefix", 128, "Prefix length of the IPv6 subnets sharing the client limits, 64 limits a /64 like a single client")
+	fs.Int64Var(&c.ShadowMaxBody, "shadow-max-body", 1<<20, "Largest request body in bytes mirrored to the shadow backend")
+	fs.Var(logLevelFlag{}, "log-level", "Minimum level of the logged messages, one of "+strings.Join(levelNames, ", "))
+	fs.Var(&c.DirectorPlugins, "director-plugin", "Go plugin exporting a Director func(*http.Request) run on every backend request, repeat for several")
+	fs.StringVar(&c.BasePath, "base-path", "", "Path the load balancer is mounted at, taken off requests before routing, others are not found")
+	fs.Var(&c.Allow, "allow", "Client ips or CIDRs allowed, use commas to separate or repeat, all when empty")
+	fs.Var(&c.Deny, "deny", "Client ips or CIDRs denied even when allowed, use commas to separate or repeat")
+	fs.Var(&c.SelfAddresses, "self-address", "Address host:port the load balancer is reached at, backends pointing there are refused, repeat for several")
+	fs.IntVar(&c.MaxHops, "max-hops", 5, "Load balancers a request may pass through before it is rejected as a loop, zero disables the check")
+	fs.Var(&c.ErrorHeaders, "error-header", "Header \"Name: value\" added to the errors the load balancer responds with, an empty value removes it, repeat for several")
+	fs.StringVar(&c.ConfigFile, "config", "", "Path to a JSON config file with pools and routes")
+	fs.IntVar(&c.Port, "port", 3030, "Port to serve")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "Certificate file to serve clients over TLS, requires -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "Private key file of the TLS certificate")
+	fs.StringVar(&c.TLSMinVersion, "tls-min-version", "1.2", "Lowest TLS version accepted from clients, one of 1.0, 1.1, 1.2, 1.3")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", "", "CA file to verify the certificates clients present against, clients are asked for one when set")
+	fs.BoolVar(&c.ForwardProxy, "forward-proxy", false, "Act as a forward proxy for CONNECT requests, tunneling them to the host:port they ask for instead of a backend")
+	fs.StringVar(&c.ForwardProxyPorts, "forward-proxy-ports", "443", "Ports CONNECT requests may tunnel to with -forward-proxy, use commas to separate, * allows any port")
+	fs.BoolVar(&c.ForwardClientTLS, "forward-client-tls", false, "Tell backends about the TLS of the client in X-Forwarded-Proto, X-Forwarded-Tls-Version, X-Forwarded-Tls-Cipher and X-Forwarded-Client-Cert")
+	fs.Var(&c.TLSCiphers, "tls-ciphers", "Cipher suites allowed for client TLS up to 1.2 such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, use commas to separate or repeat, Go's defaults when empty")
+	fs.Var(&c.Autocert, "autocert", "Domains to obtain and renew TLS certificates for from Let's Encrypt, use commas to separate or repeat, instead of -tls-cert")
+	fs.StringVar(&c.AutocertCache, "autocert-cache", "autocert", "Directory caching the certificates and account key of -autocert")
+	fs.StringVar(&c.AutocertEmail, "autocert-email", "", "Contact email of the Let's Encrypt account, notified about certificates failing to renew")
+	fs.BoolVar(&c.AutocertStaging, "autocert-staging", false, "Obtain untrusted certificates from the Let's Encrypt staging environment, for testing")
+	fs.StringVar(&c.AutocertHTTPAddr, "autocert-http-addr", ":80", "Address to answer the ACME HTTP-01 challenges on, other requests are redirected to https")
+	fs.BoolVar(&c.HTTP2, "http2", true, "Negotiate HTTP/2 with TLS clients")
+	fs.IntVar(&c.ProxyBufferSize, "proxy-buffer-size", 32*1024, "Size in bytes of the pooled buffers proxied bodies are copied with, larger buffers suit large transfers")
+	fs.DurationVar(&c.FlushInterval, "flush-interval", 0, "Interval to flush proxied responses to the client, negative flushes immediately")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "Maximum duration to read the request headers of a client")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of the request headers of a client, larger ones get 431")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", time.Minute, "Maximum duration to read a client request including the body")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 0, "Maximum duration to write a response to a client, zero disables it for streaming")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 2*time.Minute, "Maximum duration to keep an idle client connection open")
+	fs.BoolVar(&c.DisableKeepAlive, "disable-keepalive", false, "Close every client connection after one request so an L4 balancer in front spreads the requests evenly")
+	fs.StringVar(&c.Strategy, "strategy", "round-robin", "Strategy to pick backends, one of "+strings.Join(balancerNames(), ", ")+", or a comma separated chain of them")
+	fs.BoolVar(&c.Check, "check", false, "Load and validate the config, then exit without serving, non zero when it is invalid")
+	fs.BoolVar(&c.SelfTest, "selftest", false, "Send a request through the load balancer to every backend, then exit without serving, non zero when any failed")
+	fs.StringVar(&c.SelfTestPath, "selftest-path", "/", "Path of the -selftest requests, below the base path")
+	fs.StringVar(&c.SelfTestHost, "selftest-host", "", "Host header of the -selftest requests, the host of each backend url when empty")
+	fs.BoolVar(&c.Strict, "strict", false, "Refuse to start when the config has problems such as duplicate or unreachable backends")
+	fs.StringVar(&c.AdminAddr, "admin-addr", "", "Address to serve the admin API, disabled when empty")
+	fs.StringVar(&c.AdminUser, "admin-user", "", "Username required by the admin API for basic auth")
+	fs.StringVar(&c.AdminPassword, "admin-password", "", "Password required by the admin API for basic auth")
+	fs.StringVar(&c.AdminToken, "admin-token", "", "Bearer token accepted by the admin API")
+	fs.BoolVar(&c.Pprof, "pprof", false, "Serve the pprof profiles of the load balancer on the admin API under /debug/pprof/")
+}
+
+// DefaultConfig returns the config with the defaults of the command line flags
+func DefaultConfig() Config {
+	var c Config
+	RegisterFlags(flag.NewFlagSet("simplelb", flag.ContinueOnError), &c)
+	return c
+}
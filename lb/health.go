@@ -0,0 +1,212 @@
+package lb
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheckTimeout bounds a single health check probe
+const healthCheckTimeout = 2 * time.Second
+
+// maxHealthCheckBody caps how much of a health check response is read
+const maxHealthCheckBody = 64 << 10
+
+// HealthChecker decides whether the backend at a url is alive
+type HealthChecker interface {
+	// Check returns an error when the backend is not healthy
+	Check(u *url.URL) error
+}
+
+// certExpiries holds the expiry of the certificate last seen on each https backend address
+var certExpiries sync.Map
+
+// certExpiry returns when the certificate of the backend at u expires, false when it was not seen
+func certExpiry(u *url.URL) (time.Time, bool) {
+	notAfter, ok := certExpiries.Load(hostPort(u))
+	if !ok {
+		return time.Time{}, false
+	}
+	return notAfter.(time.Time), true
+}
+
+// checkCertExpiry records the expiry of the certificate presented by the backend at u,
+// failing when it has expired or, with -cert-expiry-fail, when it is about to
+func checkCertExpiry(u *url.URL, state *tls.ConnectionState) error {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	notAfter := state.PeerCertificates[0].NotAfter
+	certExpiries.Store(hostPort(u), notAfter)
+
+	left := time.Until(notAfter)
+	switch {
+	case left <= 0:
+		return fmt.Errorf("certificate of %s expired at %s", u.Host, notAfter.Format(time.RFC3339))
+	case left < cfg.CertExpiryWarning && cfg.CertExpiryFail:
+		return fmt.Errorf("certificate of %s expires at %s", u.Host, notAfter.Format(time.RFC3339))
+	case left < cfg.CertExpiryWarning:
+		logWarnf("[%s] Certificate expires at %s\n", u.Host, notAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// TCPCheck passes when a TCP connection to the backend can be established,
+// for https backends the TLS handshake must succeed as well
+type TCPCheck struct{}
+
+// Check dials the backend
+func (TCPCheck) Check(u *url.URL) error {
+	conn, err := dialBackend(u, healthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if u.Scheme != "https" {
+		return nil
+	}
+
+	// verify the certificate the same way proxied requests do
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	tlsConfig.ServerName = u.Hostname()
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.SetDeadline(time.Now().Add(healthCheckTimeout)); err != nil {
+		return err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	return checkCertExpiry(u, &state)
+}
+
+// HTTPCheck passes when a GET request to Path of the backend returns a 2xx status,
+// and when given, a body containing Body and matching BodyPattern
+type HTTPCheck struct {
+	Path        string
+	Body        string
+	BodyPattern *regexp.Regexp
+}
+
+// Check requests the health path of the backend
+func (c HTTPCheck) Check(u *url.URL) error {
+	client := http.Client{Transport: transport, Timeout: healthCheckTimeout}
+	target := *u
+	target.Path = singleJoiningSlash(target.Path, c.Path)
+
+	resp, err := client.Get(target.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check %s responded with status %d", target.Path, resp.StatusCode)
+	}
+	if c.Body != "" && !strings.Contains(string(body), c.Body) {
+		return fmt.Errorf("health check %s response does not contain %q", target.Path, c.Body)
+	}
+	if c.BodyPattern != nil && !c.BodyPattern.Match(body) {
+		return fmt.Errorf("health check %s response does not match %q", target.Path, c.BodyPattern)
+	}
+	return checkCertExpiry(u, resp.TLS)
+}
+
+// AllChecks passes when every one of its checks passes
+type AllChecks []HealthChecker
+
+// Check runs the checks in order, stopping at the first failure
+func (checks AllChecks) Check(u *url.URL) error {
+	for _, check := range checks {
+		if err := check.Check(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AnyCheck passes when at least one of its checks passes
+type AnyCheck []HealthChecker
+
+// Check runs the checks in order, stopping at the first success
+func (checks AnyCheck) Check(u *url.URL) error {
+	var failures []string
+	for _, check := range checks {
+		err := check.Check(u)
+		if err == nil {
+			return nil
+		}
+		failures = append(failures, err.Error())
+	}
+	return errors.New(strings.Join(failures, "; "))
+}
+
+// defaultHealthChecker is the health check of backends without one configured,
+// a request to -health-path when it is set and a TCP check otherwise
+func defaultHealthChecker() HealthChecker {
+	if cfg.HealthPath != "" {
+		return HTTPCheck{Path: cfg.HealthPath}
+	}
+	return TCPCheck{}
+}
+
+// newHealthChecker builds the health check described by hc, the default check when it is nil.
+// HTTP checks without a path request -health-path, or / when it is not set
+func newHealthChecker(hc *HealthCheckConfig) (HealthChecker, error) {
+	if hc == nil {
+		return defaultHealthChecker(), nil
+	}
+
+	switch hc.Type {
+	case "tcp":
+		return TCPCheck{}, nil
+	case "http":
+		path := hc.Path
+		if path == "" {
+			path = cfg.HealthPath
+		}
+		if path == "" {
+			path = "/"
+		}
+		check := HTTPCheck{Path: path, Body: hc.Body}
+		if hc.BodyPattern != "" {
+			pattern, err := regexp.Compile(hc.BodyPattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid health check body pattern: %v", err)
+			}
+			check.BodyPattern = pattern
+		}
+		return check, nil
+	case "all", "any":
+		if len(hc.Checks) == 0 {
+			return nil, fmt.Errorf("%s health check needs at least one check", hc.Type)
+		}
+		checks := make([]HealthChecker, 0, len(hc.Checks))
+		for i := range hc.Checks {
+			check, err := newHealthChecker(&hc.Checks[i])
+			if err != nil {
+				return nil, err
+			}
+			checks = append(checks, check)
+		}
+		if hc.Type == "all" {
+			return AllChecks(checks), nil
+		}
+		return AnyCheck(checks), nil
+	}
+	return nil, fmt.Errorf("unknown health check type %q", hc.Type)
+}
@@ -0,0 +1,1102 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	Attempts int = iota
+	Retry
+	TimedOut
+	accessEntryKey
+	policyKey
+	selfTestKey
+	attemptKey
+	hopsKey
+)
+
+// startTime is when the load balancer started
+var startTime = time.Now()
+
+// Backend holds the data about a server
+type Backend struct {
+	connections   int64 // first to keep it 64-bit aligned for atomic access
+	URL           *url.URL
+	Alive         bool
+	Tags          map[string]string
+	Priority      int   // tier of the backend, lower tiers take all traffic while available
+	MaxConns      int64 // active connections the backend is sized for, filling its tier spills over to the next
+	HealthChecker HealthChecker
+	Schedule      WeightSchedule
+	// RequestHeader overrides the headers of the requests sent to the backend, such as
+	// Accept-Encoding: identity for a backend mishandling compression. Set before the backend takes traffic
+	RequestHeader Headers
+	pool          string
+	weight        int
+	mux           sync.RWMutex
+	ReverseProxy  *httputil.ReverseProxy
+	transport     *http.Transport
+	user          *url.Userinfo // credentials of the backend, kept out of URL so they are not logged
+	latency       float64       // ewma of request durations in nanoseconds
+	penalty       float64       // fraction of the weight taken away by the adaptive weights
+	load          float64       // smoothed load the backend reported in -load-header
+	lastError     string
+	lastErrorAt   time.Time
+	failures      *FailureWindow // nil unless -eject-failures is set
+	outcomes      *SuccessWindow // nil unless -success-rate-window is set
+	stickyID      string
+	drainStart    time.Time // zero unless draining
+	drainUntil    time.Time // zero unless draining on its own request with -drain-header
+	probeFailures int       // consecutive failed health checks while -health-backoff-max is set
+	nextProbe     time.Time // zero unless backing off the health checks
+	discovered    bool      // created by NewDiscoveredBackend
+}
+
+// SetAlive for this backend
+func (b *Backend) SetAlive(alive bool) {
+	b.mux.Lock()
+	wasAlive := b.Alive
+	b.Alive = alive
+	if alive && !wasAlive {
+		b.lastError = ""
+		b.lastErrorAt = time.Time{}
+	}
+	lastError := b.lastError
+	b.mux.Unlock()
+
+	switch {
+	case alive && !wasAlive:
+		publishBackendEvent(EventUp, b, "")
+	case wasAlive && !alive:
+		publishBackendEvent(EventDown, b, lastError)
+	}
+
+	// failures from before the recovery do not count towards ejecting it again
+	if alive && !wasAlive && b.failures != nil {
+		b.failures.Reset()
+	}
+	// nor towards its success rate
+	if alive && !wasAlive && b.outcomes != nil {
+		b.outcomes.Reset()
+	}
+
+	// pooled connections of a dead backend are stale, drop them so the
+	// first requests after recovery do not fail on them
+	if wasAlive && !alive {
+		b.closeIdleConnections()
+	}
+}
+
+// closeIdleConnections closes the pooled connections of b which are not serving a request
+func (b *Backend) closeIdleConnections() {
+	if b.transport != nil {
+		b.transport.CloseIdleConnections()
+	}
+}
+
+// Reset gives the backend a clean slate, forgetting its failures, success rate, last error,
+// adaptive penalty and reported load, and ends an ejection by marking it alive until its next
+// health check says otherwise
+func (b *Backend) Reset() {
+	b.mux.Lock()
+	b.lastError = ""
+	b.lastErrorAt = time.Time{}
+	b.penalty = 0
+	b.load = 0
+	b.mux.Unlock()
+	if b.failures != nil {
+		b.failures.Reset()
+	}
+	if b.outcomes != nil {
+		b.outcomes.Reset()
+	}
+	b.resetProbes()
+	b.SetAlive(true)
+}
+
+// recordFailure counts a failed request of the error category in the failure window
+// of this backend, weighted by -failure-weights, returning true when the score of its
+// failures within -eject-window reached -eject-failures
+func (b *Backend) recordFailure(category string) bool {
+	if b.failures == nil {
+		return false
+	}
+	score := b.failures.Record(time.Now(), cfg.EjectWindow, cfg.FailureWeights.Weight(category))
+	return score >= float64(cfg.EjectFailures)
+}
+
+// FailureScore returns the weighted score of the failures of this backend within -eject-window
+func (b *Backend) FailureScore() float64 {
+	if b.failures == nil {
+		return 0
+	}
+	return b.failures.Score(time.Now(), cfg.EjectWindow)
+}
+
+// setLastError records err as the latest failure of this backend
+func (b *Backend) setLastError(err error) {
+	b.mux.Lock()
+	b.lastError = err.Error()
+	b.lastErrorAt = time.Now()
+	b.mux.Unlock()
+}
+
+// LastError returns the latest failure of this backend and when it happened,
+// cleared once the backend recovers
+func (b *Backend) LastError() (string, time.Time) {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.lastError, b.lastErrorAt
+}
+
+// IsAlive returns true when backend is alive
+func (b *Backend) IsAlive() (alive bool) {
+	b.mux.RLock()
+	alive = b.Alive
+	b.mux.RUnlock()
+	return
+}
+
+// authURL returns the url of the backend including its credentials
+func (b *Backend) authURL() *url.URL {
+	u := *b.URL
+	u.User = b.user
+	return &u
+}
+
+// withoutUserinfo returns a copy of u without credentials
+func withoutUserinfo(u *url.URL) *url.URL {
+	stripped := *u
+	stripped.User = nil
+	return &stripped
+}
+
+// Pool returns the name of the pool this backend belongs to
+func (b *Backend) Pool() string {
+	return b.pool
+}
+
+// SetWeight changes the share of traffic of this backend, zero stops new traffic
+func (b *Backend) SetWeight(weight int) {
+	b.mux.Lock()
+	b.weight = weight
+	b.mux.Unlock()
+}
+
+// Weight returns the share of traffic of this backend
+func (b *Backend) Weight() int {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.weight
+}
+
+// EffectiveWeight returns the weight of this backend reduced by the adaptive weight penalty,
+// the load it reported and its success rate
+func (b *Backend) EffectiveWeight() float64 {
+	share := b.successShare()
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return float64(b.weight) * (1 - b.penalty) * (1 - b.load) * share
+}
+
+// adjustPenalty moves the fraction of the weight taken away for being slow towards target
+func (b *Backend) adjustPenalty(target float64) {
+	b.mux.Lock()
+	b.penalty += adaptiveSmoothing * (target - b.penalty)
+	b.mux.Unlock()
+}
+
+// IsAvailable returns true when backend is alive and takes new traffic
+func (b *Backend) IsAvailable() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.Alive && b.weight > 0 && b.drainStart.IsZero()
+}
+
+// SetDraining starts or stops draining this backend, returning false when it
+// already was in that state. A draining backend takes no new clients, only
+// those pinned to it by sticky sessions. Draining a backend which drains on its
+// own request keeps it draining past its cooldown
+func (b *Backend) SetDraining(draining bool) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if draining && !b.drainUntil.IsZero() {
+		b.drainUntil = time.Time{}
+		return true
+	}
+	if draining == !b.drainStart.IsZero() {
+		return false
+	}
+	b.drainStart = time.Time{}
+	b.drainUntil = time.Time{}
+	if draining {
+		b.drainStart = time.Now()
+	}
+	return true
+}
+
+// Draining returns true while this backend is draining
+func (b *Backend) Draining() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return !b.drainStart.IsZero()
+}
+
+// latencyDecay is the weight given to the latest request duration in the latency ewma
+const latencyDecay = 0.3
+
+// ActiveConnections returns the number of requests in flight to this backend
+func (b *Backend) ActiveConnections() int64 {
+	return atomic.LoadInt64(&b.connections)
+}
+
+// Latency returns the ewma of the time this backend took to answer with the response
+// headers, over the responses it served
+func (b *Backend) Latency() time.Duration {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return time.Duration(b.latency)
+}
+
+// observeLatency folds a request duration into the latency ewma
+func (b *Backend) observeLatency(d time.Duration) {
+	b.mux.Lock()
+	if b.latency == 0 {
+		b.latency = float64(d)
+	} else {
+		b.latency = latencyDecay*float64(d) + (1-latencyDecay)*b.latency
+	}
+	b.mux.Unlock()
+}
+
+// attempt is a request in flight to a backend, counted in its active connections until
+// it ends or fails over to another backend
+type attempt struct {
+	backend *Backend
+	request *http.Request // as the backend got it, before its director changed a copy
+	start   time.Time     // when the request was last sent to the backend, set by the director
+	served  bool          // the backend answered with a response passed on to the client
+	ended   int32
+}
+
+// end stops counting the attempt in the active connections of its backend
+func (a *attempt) end() {
+	if atomic.CompareAndSwapInt32(&a.ended, 0, 1) {
+		atomic.AddInt64(&a.backend.connections, -1)
+	}
+}
+
+// attemptFromContext returns the attempt of the backend r is sent to or nil
+func attemptFromContext(r *http.Request) *attempt {
+	a, _ := r.Context().Value(attemptKey).(*attempt)
+	return a
+}
+
+// inboundRequest returns the request the backend of the attempt of r got, before the
+// directors changed it for the backend, along with the context and rewound body of r
+func inboundRequest(r *http.Request) *http.Request {
+	a := attemptFromContext(r)
+	if a == nil || a.request == nil {
+		return r
+	}
+	inbound := a.request.WithContext(r.Context())
+	inbound.Body, inbound.GetBody = r.Body, r.GetBody
+	return inbound
+}
+
+// ServeHTTP proxies the request to this backend while tracking connections and latency.
+// Only the responses this backend served count towards its latency and duration, not
+// the time spent failing over to another backend
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a := &attempt{backend: b, request: r}
+	atomic.AddInt64(&b.connections, 1)
+	defer a.end()
+	defer recoverProxyPanic(b, w, r)
+	recordTry(r, b)
+	start := time.Now()
+	b.ReverseProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), attemptKey, a)))
+	if a.served {
+		observeDuration(b, r, time.Since(start))
+	}
+}
+
+// recoverProxyPanic answers with a 502 when proxying r to b panicked, such as on a
+// malformed backend response, logging it with the request instead of the server
+// dropping the connection. Deliberate aborts with http.ErrAbortHandler are passed on
+func recoverProxyPanic(b *Backend, w http.ResponseWriter, r *http.Request) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	if p == http.ErrAbortHandler {
+		panic(p)
+	}
+	logErrorf("%s(%s) Panic proxying to %s: %v\n%s", r.RemoteAddr, r.URL.Path, b.URL, p, debug.Stack())
+	observeError(b, ErrorOther)
+	b.setLastError(fmt.Errorf("panic: %v", p))
+	if rw, ok := w.(*responseWriter); ok && rw.wroteHeader {
+		// the client already got part of the response, only aborting tells it something went wrong
+		panic(http.ErrAbortHandler)
+	}
+	httpError(w, r, "Bad gateway", http.StatusBadGateway)
+}
+
+// ServerPool holds information about reachable backends
+type ServerPool struct {
+	ErrorPage *ErrorPage // served when no backend is available, set before the pool takes traffic
+	MinSize   int        // fewest backends SetBackends leaves in the pool, set before the pool takes traffic
+	MaxSize   int        // most backends of the pool, zero allows any, set before the pool takes traffic
+	// Spillover of each priority tier to the next, tiers without one fail over only
+	// once they are down. Set before the pool takes traffic
+	Spillover map[int]TierSpillover
+	Fallback  http.Handler // serves in place of the error page when no backend is available, such as a sorry server
+	// SelfTestPath replaces -selftest-path for the pool, set before the pool takes traffic
+	SelfTestPath string
+	// SRV is the DNS SRV name the backends are discovered from, set before the pool takes traffic
+	SRV      string
+	name     string
+	backends []*Backend
+	balancer Balancer
+	mux      sync.RWMutex
+}
+
+// NewServerPool creates an empty pool picking backends with balancer
+func NewServerPool(name string, balancer Balancer) *ServerPool {
+	return &ServerPool{name: name, balancer: balancer}
+}
+
+// Name of the server pool
+func (s *ServerPool) Name() string {
+	return s.name
+}
+
+// Balancer returns the strategy used to pick backends
+func (s *ServerPool) Balancer() Balancer {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.balancer
+}
+
+// SetBalancer sets the strategy used to pick backends
+func (s *ServerPool) SetBalancer(balancer Balancer) {
+	s.mux.Lock()
+	s.balancer = balancer
+	s.mux.Unlock()
+}
+
+// AddBackend to the server pool
+func (s *ServerPool) AddBackend(backend *Backend) {
+	backend.pool = s.name
+	s.mux.Lock()
+	s.backends = append(s.backends, backend)
+	s.mux.Unlock()
+}
+
+// RemoveBackend from the server pool closing its idle connections, returns false when
+// it is not in the pool
+func (s *ServerPool) RemoveBackend(backendUrl *url.URL) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for i, b := range s.backends {
+		if b.URL.String() == withoutUserinfo(backendUrl).String() {
+			s.backends = append(s.backends[:i], s.backends[i+1:]...)
+			b.closeIdleConnections()
+			return true
+		}
+	}
+	return false
+}
+
+// SetBackends replaces the backends of the pool, as a discovery source does, keeping the
+// state of the backends already in it. Backends from NewDiscoveredBackend update the weight
+// of those already in it and replace them when their tags, tier or health check changed.
+// When backends are fewer than MinSize the pool keeps its last known good backends and an
+// error is returned, beyond MaxSize the rest are left out
+func (s *ServerPool) SetBackends(backends []*Backend) error {
+	if len(backends) < s.MinSize {
+		logWarnf("Pool %s would shrink to %d backends, below its minimum of %d, keeping its current backends\n", s.name, len(backends), s.MinSize)
+		return fmt.Errorf("pool %q needs at least %d backends, got %d", s.name, s.MinSize, len(backends))
+	}
+	if s.MaxSize > 0 && len(backends) > s.MaxSize {
+		logWarnf("Pool %s would grow to %d backends, capping it at %d\n", s.name, len(backends), s.MaxSize)
+		backends = backends[:s.MaxSize]
+	}
+
+	s.mux.Lock()
+	current := make(map[string]*Backend, len(s.backends))
+	for _, b := range s.backends {
+		current[b.URL.String()] = b
+	}
+	next := make([]*Backend, 0, len(backends))
+	var added []*Backend
+	for _, b := range backends {
+		if existing, ok := current[b.URL.String()]; ok && (!b.discovered || sameDiscovery(existing, b)) {
+			if b.discovered && existing.Weight() != b.Weight() {
+				logInfof("Discovered weight %d for server: %s (pool %s)\n", b.Weight(), b.URL, s.name)
+				existing.SetWeight(b.Weight())
+			}
+			next = append(next, existing)
+			delete(current, b.URL.String())
+			continue
+		}
+		b.pool = s.name
+		next = append(next, b)
+		added = append(added, b)
+	}
+	s.backends = next
+	s.mux.Unlock()
+
+	for _, b := range added {
+		logInfof("Added server: %s (pool %s)\n", b.URL, s.name)
+		publishBackendEvent(EventAdded, b, "")
+		warnUnlabeledTags(b)
+		startPriming(b)
+	}
+	for _, b := range current {
+		logInfof("Removed server: %s (pool %s)\n", b.URL, s.name)
+		publishBackendEvent(EventRemoved, b, "")
+		b.closeIdleConnections()
+	}
+	return nil
+}
+
+// GetBackend returns the backend with the given url or nil
+func (s *ServerPool) GetBackend(backendUrl *url.URL) *Backend {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, b := range s.backends {
+		if b.URL.String() == withoutUserinfo(backendUrl).String() {
+			return b
+		}
+	}
+	return nil
+}
+
+// Backends returns a snapshot of the backends in the pool
+func (s *ServerPool) Backends() []*Backend {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	backends := make([]*Backend, len(s.backends))
+	copy(backends, s.backends)
+	return backends
+}
+
+// MarkBackendStatus changes a status of a backend
+func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
+	if b := s.GetBackend(backendUrl); b != nil {
+		b.SetAlive(alive)
+	}
+}
+
+// GetNextPeer returns next active peer to take a connection
+func (s *ServerPool) GetNextPeer() *Backend {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if len(s.backends) == 0 {
+		return nil
+	}
+	// a lone backend is tried even when marked dead, giving it a chance to answer beats a 503
+	if cfg.SingleBackendPassthrough && len(s.backends) == 1 {
+		if b := s.backends[0]; b.Weight() > 0 {
+			return b
+		}
+		return nil
+	}
+	if len(s.Spillover) > 0 {
+		return s.balancer.Next(spilloverTier(s.backends, s.Spillover))
+	}
+	tier, _, _ := activeTier(s.backends)
+	return s.balancer.Next(tier)
+}
+
+// ActiveTier returns the priority of the backends taking the traffic of the pool,
+// false when no backend is available
+func (s *ServerPool) ActiveTier() (int, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	_, priority, ok := activeTier(s.backends)
+	return priority, ok
+}
+
+// activeTier returns the backends of the lowest priority with an available backend,
+// so higher tiers only take traffic once every backend of the lower tiers is down.
+// All backends are returned when none is available
+func activeTier(backends []*Backend) ([]*Backend, int, bool) {
+	priority, ok, tiered := 0, false, false
+	for _, b := range backends {
+		if b.Priority != backends[0].Priority {
+			tiered = true
+		}
+		if b.IsAvailable() && (!ok || b.Priority < priority) {
+			priority, ok = b.Priority, true
+		}
+	}
+	if !ok || !tiered {
+		return backends, priority, ok
+	}
+
+	tier := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b.Priority == priority {
+			tier = append(tier, b)
+		}
+	}
+	return tier, priority, true
+}
+
+// HealthCheck pings the backends and update the status. With -health-check-jitter
+// every backend is pinged after its own random delay so load balancers started
+// together do not probe a backend at once
+func (s *ServerPool) HealthCheck() {
+	if cfg.HealthCheckJitter <= 0 {
+		for _, b := range s.Backends() {
+			checkBackend(b)
+		}
+		return
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var wg sync.WaitGroup
+	for _, b := range s.Backends() {
+		wg.Add(1)
+		go func(b *Backend, delay time.Duration) {
+			defer wg.Done()
+			time.Sleep(delay)
+			checkBackend(b)
+		}(b, time.Duration(rng.Int63n(int64(cfg.HealthCheckJitter))))
+	}
+	wg.Wait()
+}
+
+// checkBackend pings b and updates its status
+func checkBackend(b *Backend) {
+	now := time.Now()
+	if !b.probeDue(now) {
+		logDebugf("%s [down, backing off]\n", b.URL)
+		return
+	}
+	status := "up"
+	alive := isBackendAlive(b)
+	if alive && !b.IsAlive() {
+		if cfg.WarmupRequests > 0 {
+			warmUp(b)
+		}
+		primeConnections(b)
+	}
+	b.SetAlive(alive)
+	if !alive {
+		status = "down"
+	}
+	if delay := b.observeProbe(alive, now); delay > 0 {
+		status += ", next check in " + delay.Round(time.Second).String()
+	}
+	logInfof("%s [%s]\n", b.URL, status)
+}
+
+// GetAttemptsFromContext returns the attempts for request
+func GetAttemptsFromContext(r *http.Request) int {
+	if attempts, ok := r.Context().Value(Attempts).(int); ok {
+		return attempts
+	}
+	return 1
+}
+
+// GetRetryFromContext returns the retries for request
+func GetRetryFromContext(r *http.Request) int {
+	if retry, ok := r.Context().Value(Retry).(int); ok {
+		return retry
+	}
+	return 0
+}
+
+// IsTimedOutFromContext returns true when the last backend tried timed out
+func IsTimedOutFromContext(r *http.Request) bool {
+	timedOut, _ := r.Context().Value(TimedOut).(bool)
+	return timedOut
+}
+
+// gatewayError tells the client the backend failed with an error of the category and
+// the request is not retried, with a gateway timeout when the backend was too slow
+func gatewayError(w http.ResponseWriter, r *http.Request, category string) {
+	if category == ErrorTimeout {
+		httpError(w, r, "Gateway timeout", http.StatusGatewayTimeout)
+		return
+	}
+	httpError(w, r, "Bad gateway", http.StatusBadGateway)
+}
+
+// canFailOver returns true when r can still be sent to another backend, a backend
+// response which would be retried is otherwise passed on to the client
+func canFailOver(r *http.Request) bool {
+	if GetAttemptsFromContext(r) >= 3 || !attemptsLeft(r) || !replayable(r) {
+		return false
+	}
+	return retryBudget == nil || retryBudget.Remaining() >= 1
+}
+
+// unavailable tells the client no backend could serve the request,
+// with a gateway timeout when the last backend tried was too slow
+func unavailable(w http.ResponseWriter, r *http.Request) {
+	if IsTimedOutFromContext(r) {
+		httpError(w, r, "Gateway timeout", http.StatusGatewayTimeout)
+		return
+	}
+	httpError(w, r, "Service not available", http.StatusServiceUnavailable)
+}
+
+// totalRequests counts the client requests received
+var totalRequests uint64
+
+// serve wraps the client connection and hands the request to the load balancer
+func serve(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&totalRequests, 1)
+	rw := newResponseWriter(w)
+	r, entry := withAccessEntry(r)
+	if entry != nil {
+		defer logAccess(r, rw, entry)
+	}
+	if isConnect(r) {
+		tunnel(rw, r)
+		return
+	}
+	if !stripBasePath(r) {
+		httpError(rw, r, "Not found", http.StatusNotFound)
+		return
+	}
+	withBodyTimeout(r)
+	lb(rw, r)
+}
+
+// Handler returns the handler load balancing requests over the pools of the router,
+// it can be mounted alongside other handlers or wrapped with middleware
+func Handler() http.Handler {
+	return http.HandlerFunc(serve)
+}
+
+// lb load balances the incoming request
+func lb(w http.ResponseWriter, r *http.Request) {
+	if !currentACL().Allowed(clientIP(r)) {
+		logWarnf("%s(%s) Client denied by the ACL\n", r.RemoteAddr, r.URL.Path)
+		httpError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// disallowed methods never reach a backend
+	if len(cfg.AllowedMethods) > 0 && !cfg.AllowedMethods[r.Method] {
+		w.Header().Set("Allow", strings.Replace(cfg.AllowedMethods.String(), ",", ", ", -1))
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.Context().Err(); err != nil {
+		if err == context.DeadlineExceeded {
+			logWarnf("%s(%s) Total timeout exceeded, terminating\n", r.RemoteAddr, r.URL.Path)
+			httpError(w, r, "Gateway timeout", http.StatusGatewayTimeout)
+			return
+		}
+		logInfof("%s(%s) Request cancelled, terminating: %s\n", r.RemoteAddr, r.URL.Path, err)
+		return
+	}
+
+	attempts := GetAttemptsFromContext(r)
+	if attempts > 3 {
+		logWarnf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
+		unavailable(w, r)
+		return
+	}
+
+	// retries run within the first attempt, so only it counts towards the limits
+	if attempts == 1 {
+		if cfg.MaxHops > 0 && requestHops(r) >= cfg.MaxHops {
+			logWarnf("%s(%s) Request went through %d load balancers, it is looping\n", r.RemoteAddr, r.URL.Path, requestHops(r))
+			httpError(w, r, "Loop detected", http.StatusLoopDetected)
+			return
+		}
+		r = withHops(r)
+		// the timeouts and retries of the route apply to every attempt, unless the
+		// request brought its own
+		if route := currentRouter().MatchRoute(r); route != nil && policyOf(r) == nil {
+			r = withPolicy(r, route.Policy)
+		}
+		// every attempt and retry below shares the deadline
+		if timeout := totalTimeout(r); timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		if retryBudget != nil {
+			retryBudget.Request()
+		}
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		if cfg.ShedThreshold > 0 && n > cfg.ShedThreshold && requestPriority(r) < cfg.ShedPriority {
+			logWarnf("%s(%s) Shedding low priority request, %d requests in flight\n", r.RemoteAddr, r.URL.Path, n)
+			w.Header().Set("Retry-After", "1")
+			httpError(w, r, "Service not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		if clientLimiter != nil {
+			client := limitKey(clientIP(r))
+			if !clientLimiter.Allow(client) {
+				logWarnf("%s(%s) Client exceeded its request rate\n", r.RemoteAddr, r.URL.Path)
+				httpError(w, r, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			release, ok := clientLimiter.Acquire(client)
+			if !ok {
+				logWarnf("%s(%s) Too many concurrent requests from client\n", r.RemoteAddr, r.URL.Path)
+				httpError(w, r, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			defer release()
+		}
+
+		if concurrencyLimiter != nil {
+			wait, ok := concurrencyLimiter.Acquire(r.Context())
+			observeQueueWait(wait)
+			if cfg.QueueWaitHeader {
+				w.Header().Set(queueWaitHeader, wait.String())
+			}
+			if !ok {
+				if r.Context().Err() == context.DeadlineExceeded {
+					logWarnf("%s(%s) Total timeout exceeded while queued, terminating\n", r.RemoteAddr, r.URL.Path)
+					httpError(w, r, "Gateway timeout", http.StatusGatewayTimeout)
+					return
+				}
+				if r.Context().Err() != nil {
+					logInfof("%s(%s) Request cancelled while queued, terminating\n", r.RemoteAddr, r.URL.Path)
+					return
+				}
+				logWarnf("%s(%s) Queued for %s without a free slot, rejecting\n", r.RemoteAddr, r.URL.Path, wait)
+				w.Header().Set("Retry-After", "1")
+				httpError(w, r, "Service not available", http.StatusServiceUnavailable)
+				return
+			}
+			defer concurrencyLimiter.Release()
+		}
+
+		// only requests let through reach the shadow backend or have their body read
+		if mirror != nil {
+			mirror.Send(r)
+		}
+		bufferRetryBody(r)
+	}
+
+	// identical requests in flight share a single backend response
+	if attempts == 1 && cfg.Coalesce && coalescable(r) {
+		coalesce(w, r, func(w http.ResponseWriter, r *http.Request) { forward(w, r, attempts) })
+		return
+	}
+	forward(w, r, attempts)
+}
+
+// forward picks a backend of the pool matching r and sends r to it
+func forward(w http.ResponseWriter, r *http.Request, attempts int) {
+	pool := currentRouter().Match(r)
+	if pool == nil {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// a self-test request is pinned to its backend, reached only through its own pool
+	if test := selfTestOf(r); test != nil {
+		test.pool = pool
+		if pool.GetBackend(test.backend.URL) != test.backend {
+			httpError(w, r, "Not found", http.StatusNotFound)
+			return
+		}
+		test.routed = true
+		logDebugf("%s(%s) Self-testing %s (pool %s)\n", r.RemoteAddr, r.URL.Path, test.backend.URL, pool.Name())
+		test.backend.ServeHTTP(w, r)
+		return
+	}
+
+	peer := pool.StickyPeer(r)
+	sticky := peer != nil
+	if peer == nil {
+		peer = pool.GetNextPeer()
+	}
+	if cfg.TraceDecisions {
+		decision := explainDecision(pool, peer, sticky, attempts)
+		logDebugf("%s(%s) Decision %s\n", r.RemoteAddr, r.URL.Path, decision)
+		w.Header().Add(decisionHeader, decision)
+	}
+	if peer != nil {
+		logDebugf("%s(%s) Routing to %s (pool %s) attempt %d\n", r.RemoteAddr, r.URL.Path, peer.URL, pool.Name(), attempts)
+		peer.ServeHTTP(w, r)
+		return
+	}
+	if pool.Fallback != nil {
+		logDebugf("%s(%s) No backend available, routing to the sorry server (pool %s)\n", r.RemoteAddr, r.URL.Path, pool.Name())
+		pool.Fallback.ServeHTTP(w, r)
+		return
+	}
+	if pool.ErrorPage != nil && !prefersJSON(r) {
+		pool.ErrorPage.ServeHTTP(w, r)
+		return
+	}
+	unavailable(w, r)
+}
+
+// isBackendAlive checks whether a backend is Alive by running its health check
+func isBackendAlive(b *Backend) bool {
+	if err := b.HealthChecker.Check(b.authURL()); err != nil {
+		b.setLastError(err)
+		logWarnf("Site unreachable, category=%s error=%q\n", classifyError(err), err.Error())
+		return false
+	}
+	return true
+}
+
+// warmUp primes a recovered backend with synthetic requests before it takes real traffic
+func warmUp(b *Backend) {
+	client := http.Client{Transport: transport, Timeout: 10 * time.Second}
+	u := b.authURL()
+	u.Path = singleJoiningSlash(u.Path, cfg.WarmupPath)
+
+	logInfof("Warming up %s with %d requests\n", b.URL, cfg.WarmupRequests)
+	for i := 0; i < cfg.WarmupRequests; i++ {
+		resp, err := client.Get(u.String())
+		if err != nil {
+			logWarnf("Warm up request to %s failed, category=%s error=%q\n", b.URL, classifyError(err), err.Error())
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// singleJoiningSlash joins two url paths with exactly one slash between them
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// Start runs health checking, the weight schedules and the adaptive weights in the background
+// until Stop and primes the connections to the backends
+func Start() {
+	goBackground(healthCheck)
+	goBackground(runWeightSchedules)
+	goBackground(func(ctx context.Context) { runDiscovery(ctx, cfg.DiscoveryInterval) })
+	if cfg.AdaptiveWeights > 0 {
+		goBackground(func(ctx context.Context) { runAdaptiveWeights(ctx, cfg.AdaptiveWeights) })
+	}
+	if cfg.WarmConnections > 0 {
+		primeBackends()
+	}
+}
+
+// healthCheckInterval is how often the backends are health checked
+const healthCheckInterval = 2 * time.Minute
+
+// healthCheck runs a routine for check status of the backends every 2 mins until ctx is done
+func healthCheck(ctx context.Context) {
+	t := time.NewTicker(healthCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			logInfof("Starting health check...\n")
+			for _, pool := range currentRouter().Pools() {
+				pool.HealthCheck()
+			}
+			logInfof("Health check completed\n")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// NewBackend creates a backend for u with a reverse proxy that retries and fails over,
+// credentials in u authenticate the proxied requests
+func NewBackend(backendUrl *url.URL) *Backend {
+	serverUrl := withoutUserinfo(backendUrl)
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	if user := backendUrl.User; user != nil {
+		// credentials in the backend url authenticate the proxied requests
+		director := proxy.Director
+		password, _ := user.Password()
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.SetBasicAuth(user.Username(), password)
+		}
+	}
+	// every backend gets its own connection pool so it can be dropped on its own
+	backendTransport := transport.Clone()
+	proxy.Transport = backendTransport
+	proxy.FlushInterval = cfg.FlushInterval
+	proxy.BufferPool = proxyBuffers
+	backend := &Backend{
+		URL:           serverUrl,
+		Alive:         true,
+		weight:        1,
+		ReverseProxy:  proxy,
+		HealthChecker: defaultHealthChecker(),
+		transport:     backendTransport,
+		user:          backendUrl.User,
+		stickyID:      stickyID(serverUrl.String()),
+	}
+	if cfg.EjectFailures > 0 {
+		backend.failures = NewFailureWindow()
+	}
+	if cfg.SuccessRateWindow > 0 {
+		backend.outcomes = NewSuccessWindow()
+	}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		if a := attemptFromContext(req); a != nil {
+			a.start = time.Now()
+		}
+		countHop(req)
+		countSend(req)
+		if cfg.ForwardClientTLS {
+			forwardClientTLS(req)
+		}
+		runDirectors(req)
+		backend.RequestHeader.ApplyRequest(req)
+		req.Body = countBody(req.Body, func(n int64) { observeRequestSize(backend, n) })
+	}
+	proxy.ModifyResponse = func(response *http.Response) error {
+		// the body is not sent to the client yet, so failing here fails the request over
+		// to another backend, once it cannot the last response is passed on as it is
+		if retryOnStatus(response.Request, response.StatusCode) && canFailOver(response.Request) {
+			return &statusError{code: response.StatusCode}
+		}
+		if cfg.RetryOnHeader.Matches(response.Header) && canFailOver(response.Request) {
+			return &overloadError{header: cfg.RetryOnHeader.String()}
+		}
+		if a := attemptFromContext(response.Request); a != nil {
+			a.served = true
+			backend.observeLatency(time.Since(a.start))
+		}
+		observeResponse(backend, response.StatusCode)
+		observeDrainHeader(backend, response)
+		backend.recordOutcome(response.StatusCode < http.StatusInternalServerError)
+		if load, ok := reportedLoad(response); ok {
+			backend.observeLoad(load)
+		}
+		normalizeFraming(response)
+		if cfg.RewriteLocation && response.StatusCode >= 300 && response.StatusCode < 400 {
+			if location := response.Header.Get("Location"); location != "" {
+				response.Header.Set("Location", rewriteLocation(location, serverUrl, response.Request))
+			}
+		}
+		if cfg.StickyCookie != "" {
+			setStickyCookie(response, backend)
+		}
+		// upgraded connections need the raw body to take over the connection
+		if response.StatusCode != http.StatusSwitchingProtocols {
+			response.Body = countBody(response.Body, func(n int64) { observeResponseSize(backend, n) })
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
+		// the client stalled sending its body, the backend is not to blame
+		if errors.Is(e, errBodyTimeout) {
+			logWarnf("%s(%s) Request body stalled for %s, aborting\n", request.RemoteAddr, request.URL.Path, cfg.BodyReadTimeout)
+			writer.Header().Set("Connection", "close")
+			httpError(writer, request, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+		category := classifyError(e)
+		// the client went away, the backend is not to blame and there is nobody to fail over for
+		if category == ErrorCanceled || request.Context().Err() == context.Canceled {
+			logInfof("%s(%s) Client disconnected before the response of %s\n", request.RemoteAddr, request.URL.Path, serverUrl.Host)
+			observeClientDisconnect()
+			return
+		}
+		logWarnf("[%s] category=%s error=%q\n", serverUrl.Host, category, e.Error())
+		observeError(backend, category)
+		// the backend is not to blame when the total timeout ran out, and there is no time to fail over
+		if request.Context().Err() == context.DeadlineExceeded {
+			logWarnf("%s(%s) Total timeout exceeded, terminating\n", request.RemoteAddr, request.URL.Path)
+			httpError(writer, request, "Gateway timeout", http.StatusGatewayTimeout)
+			return
+		}
+		backend.recordOutcome(false)
+		backend.setLastError(e)
+		if backend.recordFailure(category) && backend.IsAlive() {
+			logWarnf("[%s] Failure score reached %d within %s, ejecting\n", serverUrl.Host, cfg.EjectFailures, cfg.EjectWindow)
+			publishBackendEvent(EventEject, backend, fmt.Sprintf("failure score reached %d within %s", cfg.EjectFailures, cfg.EjectWindow))
+			backend.SetAlive(false)
+		}
+		// a body streamed to the backend already cannot be sent to another one
+		rewound, ok := rewindBody(request)
+		if !ok {
+			logWarnf("%s(%s) Request body cannot be replayed, not retrying\n", request.RemoteAddr, request.URL.Path)
+			gatewayError(writer, request, category)
+			return
+		}
+		// the directors changed the backend request for this backend, such as with its
+		// credentials, so retries and failovers start over from the request it got
+		request = inboundRequest(rewound)
+		if !attemptsLeft(request) {
+			logWarnf("%s(%s) Max attempts reached, not retrying\n", request.RemoteAddr, request.URL.Path)
+			gatewayError(writer, request, category)
+			return
+		}
+		if retryBudget != nil && !retryBudget.Withdraw() {
+			logWarnf("%s(%s) Retry budget exhausted, not retrying\n", request.RemoteAddr, request.URL.Path)
+			observeThrottledRetry()
+			gatewayError(writer, request, category)
+			return
+		}
+		retries := GetRetryFromContext(request)
+		// a backend which timed out is not retried, it would only make the client wait longer,
+		// nor is one just ejected, overloaded or answering with a status to retry on
+		if retries < 3 && category != ErrorTimeout && category != ErrorOverload && category != ErrorStatus && backend.IsAlive() {
+			select {
+			case <-time.After(10 * time.Millisecond):
+				ctx := context.WithValue(request.Context(), Retry, retries+1)
+				proxy.ServeHTTP(writer, request.WithContext(ctx))
+			case <-request.Context().Done():
+				// the client is gone or the total timeout ran out, do not send more work upstream
+				if request.Context().Err() == context.DeadlineExceeded {
+					httpError(writer, request, "Gateway timeout", http.StatusGatewayTimeout)
+				}
+			}
+			return
+		}
+
+		// after 3 retries or a timeout, mark this backend as down, an overloaded one or one
+		// answering with a status to retry on is only left out of this request and ejected
+		// by its failure score
+		if category != ErrorOverload && category != ErrorStatus {
+			backend.SetAlive(false)
+		}
+
+		// if the same request routing for few attempts with different backends, increase the count
+		attempts := GetAttemptsFromContext(request)
+		logInfof("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
+		// the next backend is busy with the request from here on, not this one
+		if a := attemptFromContext(request); a != nil {
+			a.end()
+		}
+		ctx := context.WithValue(request.Context(), Attempts, attempts+1)
+		ctx = context.WithValue(ctx, TimedOut, category == ErrorTimeout)
+		lb(writer, request.WithContext(ctx))
+	}
+	return backend
+}
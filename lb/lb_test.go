@@ -0,0 +1,184 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testBackends returns n alive backends which are never dialed
+func testBackends(t *testing.T, n int) []*Backend {
+	if err := Configure(DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	backends := make([]*Backend, n)
+	for i := range backends {
+		u, _ := url.Parse(fmt.Sprintf("http://backend-%d", i))
+		backends[i] = NewBackend(u)
+	}
+	return backends
+}
+
+// serveBackends routes the default pool of the given backend urls and serves the load balancer
+func serveBackends(t *testing.T, c Config, urls ...string) (*httptest.Server, *ServerPool) {
+	if err := Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	pool := NewServerPool(DefaultPool, &RoundRobin{})
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.AddBackend(NewBackend(u))
+	}
+	rt := NewRouter()
+	rt.AddPool(pool)
+	SetRouter(rt)
+	return httptest.NewServer(Handler()), pool
+}
+
+func TestSetBackendsKeepsThePoolWithinItsSize(t *testing.T) {
+	backends := testBackends(t, 4)
+	pool := NewServerPool("api", &RoundRobin{})
+	pool.MinSize, pool.MaxSize = 2, 3
+
+	if err := pool.SetBackends(backends); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(pool.Backends()); got != 3 {
+		t.Errorf("pool has %d backends, want them capped at max_backends 3", got)
+	}
+	if err := pool.SetBackends(backends[:1]); err == nil {
+		t.Error("shrinking below min_backends returned no error")
+	}
+	if got := len(pool.Backends()); got != 3 {
+		t.Errorf("pool has %d backends, want the 3 last good ones kept", got)
+	}
+	if err := pool.SetBackends(backends[1:3]); err != nil {
+		t.Fatal(err)
+	}
+	if got := pool.Backends(); len(got) != 2 || got[0] != backends[1] {
+		t.Errorf("pool has %d backends, want the 2 given keeping their state", len(got))
+	}
+}
+
+func TestFailoverDropsTheCredentialsOfTheFailedBackend(t *testing.T) {
+	// the connections to the backend with credentials are refused, failing it over
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	var auth []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+
+	withCredentials := "http://alice:secret@" + closed.Listener.Addr().String()
+	server, pool := serveBackends(t, DefaultConfig(), withCredentials, other.URL)
+	defer server.Close()
+	defer Configure(DefaultConfig())
+
+	// one of the requests goes to the backend with credentials first, whichever it is
+	for i := 0; i < 2; i++ {
+		resp, err := server.Client().Get(server.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+	if pool.Backends()[0].IsAlive() {
+		t.Error("no request failed over from the backend with credentials")
+	}
+	for _, got := range auth {
+		if got != "" {
+			t.Errorf("backend without credentials got Authorization %q", got)
+		}
+	}
+}
+
+func TestRetriesAndFailoverCountOneHop(t *testing.T) {
+	// the connections to the first backend are refused, so it is retried before failing over
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	var hops, forwarded []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops = append(hops, r.Header.Get(hopsHeader))
+		forwarded = append(forwarded, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer other.Close()
+
+	server, pool := serveBackends(t, DefaultConfig(), "http://"+closed.Listener.Addr().String(), other.URL)
+	defer server.Close()
+	defer Configure(DefaultConfig())
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		req.Header.Set(hopsHeader, "1")
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+	if pool.Backends()[0].IsAlive() {
+		t.Error("no request was retried and failed over")
+	}
+	for i := range hops {
+		if hops[i] != "2" {
+			t.Errorf("backend got %s %q, want the client's 1 hop plus this load balancer", hopsHeader, hops[i])
+		}
+		if forwarded[i] != "127.0.0.1" {
+			t.Errorf("backend got X-Forwarded-For %q, want the client once", forwarded[i])
+		}
+	}
+}
+
+func TestRemovedBackendsCloseTheirIdleConnections(t *testing.T) {
+	for _, remove := range []struct {
+		name string
+		fn   func(pool *ServerPool)
+	}{
+		{"RemoveBackend", func(pool *ServerPool) { pool.RemoveBackend(pool.Backends()[0].URL) }},
+		{"SetBackends", func(pool *ServerPool) { pool.SetBackends(nil) }},
+	} {
+		closed := make(chan struct{}, 1)
+		server := httptest.NewUnstartedServer(http.NotFoundHandler())
+		server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed {
+				select {
+				case closed <- struct{}{}:
+				default:
+				}
+			}
+		}
+		server.Start()
+
+		lbServer, pool := serveBackends(t, DefaultConfig(), server.URL)
+		// leaves the connection to the backend idle in its pool
+		resp, err := lbServer.Client().Get(lbServer.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		remove.fn(pool)
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s left the idle connection of the removed backend open", remove.name)
+		}
+		Configure(DefaultConfig())
+		lbServer.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,180 @@
+// Package lbtest runs the load balancer end to end in front of fake backends whose
+// latency, error rate and status code are controlled by the test
+package lbtest
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kasvith/simplelb/lb"
+)
+
+// Backend is a fake backend served by an httptest.Server, answering 200 right away
+// unless told otherwise
+type Backend struct {
+	*httptest.Server
+	hits      int64 // first to keep it 64-bit aligned for atomic access
+	cancels   int64
+	cancelled chan struct{}
+	once      sync.Once
+	mux       sync.Mutex
+	latency   time.Duration
+	errorRate float64
+	status    int
+	lastBody  []byte
+}
+
+// NewBackend starts a fake backend, close it when done
+func NewBackend() *Backend {
+	b := &Backend{status: http.StatusOK, cancelled: make(chan struct{})}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	return b
+}
+
+// serve answers a request as the backend is currently told to
+func (b *Backend) serve(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&b.hits, 1)
+	body, _ := ioutil.ReadAll(r.Body)
+	b.mux.Lock()
+	latency, errorRate, status := b.latency, b.errorRate, b.status
+	b.lastBody = body
+	b.mux.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			atomic.AddInt64(&b.cancels, 1)
+			b.once.Do(func() { close(b.cancelled) })
+			return
+		}
+	}
+	if errorRate > 0 && rand.Float64() < errorRate {
+		status = http.StatusInternalServerError
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, b.URL)
+}
+
+// SetLatency delays every response by d
+func (b *Backend) SetLatency(d time.Duration) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.latency = d
+}
+
+// SetErrorRate answers this fraction of the requests with 500
+func (b *Backend) SetErrorRate(rate float64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.errorRate = rate
+}
+
+// SetStatus answers the requests with code
+func (b *Backend) SetStatus(code int) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.status = code
+}
+
+// LastBody returns the body of the last request the backend got
+func (b *Backend) LastBody() []byte {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.lastBody
+}
+
+// Hits returns the number of requests the backend got, health checks included
+func (b *Backend) Hits() int64 {
+	return atomic.LoadInt64(&b.hits)
+}
+
+// Cancellations returns the number of requests given up by the load balancer while
+// the backend was still delaying them
+func (b *Backend) Cancellations() int64 {
+	return atomic.LoadInt64(&b.cancels)
+}
+
+// Cancelled returns a channel closed once the first request is given up by the load
+// balancer while the backend was still delaying it
+func (b *Backend) Cancelled() <-chan struct{} {
+	return b.cancelled
+}
+
+// ResetHits starts counting the requests over
+func (b *Backend) ResetHits() {
+	atomic.StoreInt64(&b.hits, 0)
+}
+
+// Distribution returns the share of the requests each of backends got
+func Distribution(backends ...*Backend) []float64 {
+	var total int64
+	for _, b := range backends {
+		total += b.Hits()
+	}
+	shares := make([]float64, len(backends))
+	if total == 0 {
+		return shares
+	}
+	for i, b := range backends {
+		shares[i] = float64(b.Hits()) / float64(total)
+	}
+	return shares
+}
+
+// LB is the load balancer served by an httptest.Server in front of a pool of
+// fake backends. The load balancer keeps its state in its package, so only one
+// LB may run at a time
+type LB struct {
+	*httptest.Server
+	Pool *lb.ServerPool
+}
+
+// Start configures the load balancer with c and serves the default pool of backends
+// picked by balancer. Health checks only run when asked for with CheckHealth
+func Start(c lb.Config, balancer lb.Balancer, backends ...*Backend) (*LB, error) {
+	if err := lb.Configure(c); err != nil {
+		return nil, err
+	}
+	pool := lb.NewServerPool(lb.DefaultPool, balancer)
+	for _, b := range backends {
+		u, err := url.Parse(b.URL)
+		if err != nil {
+			return nil, err
+		}
+		pool.AddBackend(lb.NewBackend(u))
+	}
+	router := lb.NewRouter()
+	router.AddPool(pool)
+	lb.SetRouter(router)
+	return &LB{Server: httptest.NewServer(lb.Handler()), Pool: pool}, nil
+}
+
+// CheckHealth runs a round of health checks over the pool and returns when it is done
+func (l *LB) CheckHealth() {
+	l.Pool.HealthCheck()
+}
+
+// Get sends n sequential GET requests for path and counts the responses by status code
+func (l *LB) Get(path string, n int) (map[int]int, error) {
+	statuses := make(map[int]int)
+	for i := 0; i < n; i++ {
+		resp, err := l.Client().Get(l.URL + path)
+		if err != nil {
+			return statuses, err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		statuses[resp.StatusCode]++
+	}
+	return statuses, nil
+}
@@ -0,0 +1,132 @@
+package lbtest_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kasvith/simplelb/lb"
+	"github.com/kasvith/simplelb/lb/lbtest"
+)
+
+func TestFailover(t *testing.T) {
+	dead, live := lbtest.NewBackend(), lbtest.NewBackend()
+	defer live.Close()
+	l, err := lbtest.Start(lb.DefaultConfig(), &lb.RoundRobin{}, dead, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dead.Close()
+
+	statuses, err := l.Get("/", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[http.StatusOK] != 10 {
+		t.Errorf("statuses = %v, want every request served by the live backend", statuses)
+	}
+	if live.Hits() != 10 {
+		t.Errorf("live backend got %d requests, want 10", live.Hits())
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	sick, healthy := lbtest.NewBackend(), lbtest.NewBackend()
+	defer sick.Close()
+	defer healthy.Close()
+	c := lb.DefaultConfig()
+	c.HealthPath = "/health"
+	l, err := lbtest.Start(c, &lb.RoundRobin{}, sick, healthy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	sick.SetStatus(http.StatusServiceUnavailable)
+	l.CheckHealth()
+	sick.ResetHits()
+	healthy.ResetHits()
+
+	statuses, err := l.Get("/", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[http.StatusOK] != 10 {
+		t.Errorf("statuses = %v, want every request served by the healthy backend", statuses)
+	}
+	if shares := lbtest.Distribution(sick, healthy); shares[0] != 0 || shares[1] != 1 {
+		t.Errorf("distribution = %v, want [0 1]", shares)
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	backends := []*lbtest.Backend{lbtest.NewBackend(), lbtest.NewBackend()}
+	for _, b := range backends {
+		defer b.Close()
+	}
+	l, err := lbtest.Start(lb.DefaultConfig(), &lb.RoundRobin{}, backends...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := l.Get("/", 10); err != nil {
+		t.Fatal(err)
+	}
+	if shares := lbtest.Distribution(backends...); shares[0] != 0.5 || shares[1] != 0.5 {
+		t.Errorf("distribution = %v, want round robin to split evenly", shares)
+	}
+}
+
+func TestErrorRateRetries(t *testing.T) {
+	flaky, healthy := lbtest.NewBackend(), lbtest.NewBackend()
+	defer flaky.Close()
+	defer healthy.Close()
+	flaky.SetErrorRate(1)
+	c := lb.DefaultConfig()
+	c.RetryOn = lb.StatusCodes{http.StatusInternalServerError: true}
+	l, err := lbtest.Start(c, &lb.RoundRobin{}, flaky, healthy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	statuses, err := l.Get("/", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[http.StatusOK] != 10 {
+		t.Errorf("statuses = %v, want every request retried on the healthy backend", statuses)
+	}
+	if healthy.Hits() != 10 {
+		t.Errorf("healthy backend got %d requests, want 10", healthy.Hits())
+	}
+}
+
+func TestErrorRateRetryBudget(t *testing.T) {
+	flaky, healthy := lbtest.NewBackend(), lbtest.NewBackend()
+	defer flaky.Close()
+	defer healthy.Close()
+	flaky.SetErrorRate(1)
+	c := lb.DefaultConfig()
+	c.RetryOn = lb.StatusCodes{http.StatusInternalServerError: true}
+	c.RetryBudget = 0
+	c.RetryBudgetMin = 2
+	l, err := lbtest.Start(c, &lb.RoundRobin{}, flaky, healthy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// every request reaching the flaky backend wants a retry, only the first two get one
+	statuses, err := l.Get("/", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retries := flaky.Hits() + healthy.Hits() - 10; retries != 2 {
+		t.Errorf("%d requests retried, want the 2 of -retry-budget-min", retries)
+	}
+	if statuses[http.StatusInternalServerError] != int(flaky.Hits())-2 {
+		t.Errorf("statuses = %v, want the errors of the %d requests not retried passed on", statuses, flaky.Hits()-2)
+	}
+}
@@ -0,0 +1,91 @@
+package lb
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lifecycle tracks the background goroutines of the load balancer so Stop can end them
+var lifecycle struct {
+	mux    sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	timers map[*time.Timer]bool
+}
+
+// goBackground runs fn in a goroutine until the load balancer stops, fn must return
+// once ctx is done
+func goBackground(fn func(ctx context.Context)) {
+	lifecycle.mux.Lock()
+	if lifecycle.ctx == nil {
+		lifecycle.ctx, lifecycle.cancel = context.WithCancel(context.Background())
+	}
+	ctx := lifecycle.ctx
+	lifecycle.wg.Add(1)
+	lifecycle.mux.Unlock()
+
+	go func() {
+		defer lifecycle.wg.Done()
+		fn(ctx)
+	}()
+}
+
+// afterBackground runs fn in its own goroutine after d, unless the load balancer stops first
+func afterBackground(d time.Duration, fn func()) {
+	lifecycle.mux.Lock()
+	defer lifecycle.mux.Unlock()
+	if lifecycle.timers == nil {
+		lifecycle.timers = make(map[*time.Timer]bool)
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		lifecycle.mux.Lock()
+		pending := lifecycle.timers[t]
+		delete(lifecycle.timers, t)
+		lifecycle.mux.Unlock()
+		// a timer firing while Stop ran is left out
+		if pending {
+			fn()
+		}
+	})
+	lifecycle.timers[t] = true
+}
+
+// Stop ends the background goroutines of the load balancer, such as the health checks
+// run by Start, and the timers pending, and waits for the goroutines to exit. Start may
+// be called again afterwards
+func Stop() {
+	lifecycle.mux.Lock()
+	if lifecycle.cancel != nil {
+		lifecycle.cancel()
+	}
+	lifecycle.ctx, lifecycle.cancel = nil, nil
+	for t := range lifecycle.timers {
+		t.Stop()
+	}
+	lifecycle.timers = nil
+	lifecycle.mux.Unlock()
+	lifecycle.wg.Wait()
+}
+
+// handleShutdownSignal calls shutdown to drain the load balancer when SIGINT or
+// SIGTERM is received
+func handleShutdownSignal(ctx context.Context, shutdown func(ctx context.Context)) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case <-sig:
+		logInfof("Shutting down, draining connections\n")
+		// a shutdown drains for as long as a reload may
+		drainCtx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+		defer cancel()
+		shutdown(drainCtx)
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,32 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+func TestStopEndsBackgroundGoroutines(t *testing.T) {
+	// the backend never answers, so priming its connections lasts until Stop
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+
+	c := DefaultConfig()
+	c.AdaptiveWeights = time.Second
+	c.WarmConnections = 2
+	server, _ := serveBackends(t, c, hanging.URL)
+	server.Close()
+	defer Configure(DefaultConfig())
+	ignore := goleak.IgnoreCurrent()
+
+	for i := 0; i < 3; i++ {
+		Start()
+		Stop()
+		goleak.VerifyNone(t, ignore)
+	}
+}
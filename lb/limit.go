@@ -0,0 +1,192 @@
+package lb
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// inFlight counts the client requests being served
+var inFlight int64
+
+// requestPriority returns the priority given in the priority header of r, 0 when absent or invalid
+func requestPriority(r *http.Request) int {
+	priority, err := strconv.Atoi(r.Header.Get(cfg.PriorityHeader))
+	if err != nil {
+		return 0
+	}
+	return priority
+}
+
+// LimitStore keeps the counters of the client limits, in memory or shared by
+// several load balancers
+type LimitStore interface {
+	// Acquire takes one of max concurrency slots of key, false when all are taken
+	Acquire(key string, max int) (bool, error)
+	// Release gives back a concurrency slot of key
+	Release(key string) error
+	// Allow counts a request of key in the current window, false when it exceeds limit
+	Allow(key string, limit int, window time.Duration) (bool, error)
+}
+
+// newLimitStore creates the limit store described by spec, "memory" or a redis url
+func newLimitStore(spec string) (LimitStore, error) {
+	if spec == "" || spec == "memory" {
+		return NewMemoryLimitStore(), nil
+	}
+	return NewRedisLimitStore(spec)
+}
+
+// MemoryLimitStore is a LimitStore private to this load balancer
+type MemoryLimitStore struct {
+	mux      sync.Mutex
+	inFlight map[string]int
+	windows  map[string]*rateWindow
+	swept    int64
+}
+
+// rateWindow counts the requests of a key in the window with index start
+type rateWindow struct {
+	start int64
+	n     int
+}
+
+// NewMemoryLimitStore creates an empty in memory limit store
+func NewMemoryLimitStore() *MemoryLimitStore {
+	return &MemoryLimitStore{inFlight: make(map[string]int), windows: make(map[string]*rateWindow)}
+}
+
+// Acquire takes a slot of key
+func (s *MemoryLimitStore) Acquire(key string, max int) (bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.inFlight[key] >= max {
+		return false, nil
+	}
+	s.inFlight[key]++
+	return true, nil
+}
+
+// Release gives back a slot of key, forgetting keys without requests in flight
+func (s *MemoryLimitStore) Release(key string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.inFlight[key] <= 1 {
+		delete(s.inFlight, key)
+		return nil
+	}
+	s.inFlight[key]--
+	return nil
+}
+
+// Allow counts a request of key in a fixed window
+func (s *MemoryLimitStore) Allow(key string, limit int, window time.Duration) (bool, error) {
+	start := time.Now().UnixNano() / int64(window)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// forget the keys of past windows once per window
+	if start != s.swept {
+		for k, w := range s.windows {
+			if w.start != start {
+				delete(s.windows, k)
+			}
+		}
+		s.swept = start
+	}
+
+	w, ok := s.windows[key]
+	if !ok {
+		w = &rateWindow{start: start}
+		s.windows[key] = w
+	}
+	if w.n >= limit {
+		return false, nil
+	}
+	w.n++
+	return true, nil
+}
+
+// ClientLimiter caps the request rate and the concurrent requests of each client,
+// an ip or subnet given by limitKey, a zero Rate or Max does not limit
+type ClientLimiter struct {
+	Max    int
+	Rate   int
+	Window time.Duration
+	Store  LimitStore
+}
+
+// NewClientLimiter creates a limiter allowing max concurrent requests and rate
+// requests per window for each client
+func NewClientLimiter(max, rate int, window time.Duration, store LimitStore) *ClientLimiter {
+	return &ClientLimiter{Max: max, Rate: rate, Window: window, Store: store}
+}
+
+// Allow counts a request of client, returning false when the client exceeds its rate.
+// Requests are allowed when the store fails so it is not a single point of failure
+func (l *ClientLimiter) Allow(client string) bool {
+	if l.Rate <= 0 {
+		return true
+	}
+	ok, err := l.Store.Allow("rate:"+client, l.Rate, l.Window)
+	if err != nil {
+		logWarnf("Rate limit of %s not checked: %s\n", client, err)
+		return true
+	}
+	return ok
+}
+
+// Acquire takes a slot for client, returning false when the client is at its limit.
+// release gives the slot back, it does nothing when no slot was taken. As with Allow,
+// requests are allowed without a slot when the store fails
+func (l *ClientLimiter) Acquire(client string) (release func(), ok bool) {
+	if l.Max <= 0 {
+		return func() {}, true
+	}
+	key := "conn:" + client
+	ok, err := l.Store.Acquire(key, l.Max)
+	if err != nil {
+		logWarnf("Concurrency limit of %s not checked: %s\n", client, err)
+		return func() {}, true
+	}
+	if !ok {
+		return nil, false
+	}
+	return func() {
+		if err := l.Store.Release(key); err != nil {
+			logWarnf("Concurrency slot of %s not released: %s\n", client, err)
+		}
+	}, true
+}
+
+// limitKey returns the key the limits of the client at ip are counted under, its
+// subnet of -limit-ipv4-prefix or -limit-ipv6-prefix bits so clients rotating ips
+// within a subnet share the limits
+func limitKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	prefix, bits := cfg.LimitIPv6Prefix, 8*net.IPv6len
+	if ip4 := parsed.To4(); ip4 != nil {
+		parsed, prefix, bits = ip4, cfg.LimitIPv4Prefix, 8*net.IPv4len
+	}
+	if prefix >= bits {
+		return parsed.String()
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String()
+}
+
+// clientIP returns the ip of the client which sent r
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+var clientLimiter *ClientLimiter
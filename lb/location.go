@@ -0,0 +1,69 @@
+package lb
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// stripBasePath takes -base-path off the path of r, false when r is outside of it
+func stripBasePath(r *http.Request) bool {
+	if cfg.BasePath == "" {
+		return true
+	}
+	if r.URL.Path != cfg.BasePath && !strings.HasPrefix(r.URL.Path, cfg.BasePath+"/") {
+		return false
+	}
+	r.URL.Path = r.URL.Path[len(cfg.BasePath):]
+	if r.URL.Path == "" {
+		r.URL.Path = "/"
+	}
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, cfg.BasePath)
+		if r.URL.RawPath == "" {
+			r.URL.RawPath = "/"
+		}
+	}
+	return true
+}
+
+// rewriteLocation maps a Location sent by the backend at backendUrl to the address the
+// client used for req, so redirects do not leak the backend address. Relative locations
+// only lose the path the backend is mounted at and gain -base-path, locations naming
+// another host are kept
+func rewriteLocation(location string, backendUrl *url.URL, req *http.Request) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if u.Host != "" {
+		if hostPort(&url.URL{Scheme: backendUrl.Scheme, Host: u.Host}) != hostPort(backendUrl) {
+			return location
+		}
+		if u.Scheme != "" {
+			u.Scheme = "http"
+			if req.TLS != nil {
+				u.Scheme = "https"
+			}
+		}
+		u.Host = req.Host
+	} else if !strings.HasPrefix(u.Path, "/") {
+		return location
+	}
+
+	// requests get the backend path prepended, take it off again
+	if prefix := strings.TrimSuffix(backendUrl.Path, "/"); prefix != "" {
+		if u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+			u.Path = u.Path[len(prefix):]
+			u.RawPath = ""
+			if u.Path == "" {
+				u.Path = "/"
+			}
+		}
+	}
+	if cfg.BasePath != "" {
+		u.Path = cfg.BasePath + u.Path
+		u.RawPath = ""
+	}
+	return u.String()
+}
@@ -0,0 +1,88 @@
+package lb
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the minimum severity of the messages written to the log
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String returns the name of the level
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("LogLevel(%d)", l)
+	}
+	return levelNames[l]
+}
+
+// parseLogLevel returns the level with the given name
+func parseLogLevel(name string) (LogLevel, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, use one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// logLevel is the current level, it can be changed at runtime through the admin api
+var logLevel = LevelInfo
+
+// currentLogLevel returns the current level
+func currentLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32((*int32)(&logLevel)))
+}
+
+// setLogLevel changes the current level
+func setLogLevel(l LogLevel) {
+	atomic.StoreInt32((*int32)(&logLevel), int32(l))
+}
+
+// logLevelFlag binds the current level to a flag
+type logLevelFlag struct{}
+
+// String returns the name of the current level
+func (logLevelFlag) String() string {
+	return currentLogLevel().String()
+}
+
+// Set changes the current level to the named one
+func (logLevelFlag) Set(value string) error {
+	l, err := parseLogLevel(value)
+	if err != nil {
+		return err
+	}
+	setLogLevel(l)
+	return nil
+}
+
+// logf writes the message to the log when level is enabled
+func logf(level LogLevel, format string, v ...interface{}) {
+	if level >= currentLogLevel() {
+		log.Output(3, fmt.Sprintf(format, v...))
+	}
+}
+
+// logDebugf logs details such as the backend chosen for every request
+func logDebugf(format string, v ...interface{}) { logf(LevelDebug, format, v...) }
+
+// logInfof logs regular events such as backends changing state
+func logInfof(format string, v ...interface{}) { logf(LevelInfo, format, v...) }
+
+// logWarnf logs failures the load balancer recovers from
+func logWarnf(format string, v ...interface{}) { logf(LevelWarn, format, v...) }
+
+// logErrorf logs failures the load balancer cannot recover from
+func logErrorf(format string, v ...interface{}) { logf(LevelError, format, v...) }
@@ -0,0 +1,80 @@
+package lb
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hopsHeader counts the load balancers a request went through, to stop requests
+// looping through load balancers configured as each other's backends
+const hopsHeader = "X-Simplelb-Hops"
+
+// requestHops returns the hops r went through before reaching this load balancer
+func requestHops(r *http.Request) int {
+	hops, err := strconv.Atoi(r.Header.Get(hopsHeader))
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+// withHops returns r carrying the hops it went through, counted once before any
+// attempt or retry sends it on
+func withHops(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), hopsKey, requestHops(r)))
+}
+
+// countHop adds this load balancer to the hops of the client request of a backend request.
+// It is counted from the client request, so the directors of retries and failovers
+// running again do not count this load balancer again
+func countHop(req *http.Request) {
+	hops, ok := req.Context().Value(hopsKey).(int)
+	if !ok {
+		hops = requestHops(req)
+	}
+	req.Header.Set(hopsHeader, strconv.Itoa(hops+1))
+}
+
+// isSelf returns true when u points at the load balancer itself, by one of its
+// local addresses on -port, its hostname or one of the -self-address identities
+func isSelf(u *url.URL) bool {
+	addr := hostPort(u)
+	for _, self := range cfg.SelfAddresses {
+		if strings.EqualFold(addr, self) {
+			return true
+		}
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(cfg.Port) {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if hostname, err := os.Hostname(); err == nil && strings.EqualFold(host, hostname) {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
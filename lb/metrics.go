@@ -0,0 +1,323 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the metrics served on the admin /metrics endpoint
+var metricsRegistry = prometheus.NewRegistry()
+
+// tagKeys are the backend tag keys added as labels to the backend metrics,
+// fixed at startup since every series of a metric needs the same labels
+var tagKeys []string
+
+var (
+	backendRequests  *prometheus.CounterVec
+	backendErrors    *prometheus.CounterVec
+	backendDurations *prometheus.HistogramVec
+	requestSizes     *prometheus.HistogramVec
+	responseSizes    *prometheus.HistogramVec
+	throttledRetries prometheus.Counter
+	disconnects      prometheus.Counter
+	queueWaits       prometheus.Histogram
+
+	backendUpDesc          *prometheus.Desc
+	backendConnectionsDesc *prometheus.Desc
+	backendWeightDesc      *prometheus.Desc
+	backendCertExpiryDesc  *prometheus.Desc
+)
+
+// sizeBuckets are the body size buckets in bytes, from 100B to 100MB
+var sizeBuckets = prometheus.ExponentialBuckets(100, 10, 7)
+
+// invalidLabelChars matches the characters not allowed in prometheus label names
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// tagLabel returns the label name of a backend tag
+func tagLabel(key string) string {
+	return "tag_" + invalidLabelChars.ReplaceAllString(key, "_")
+}
+
+// backendLabels returns the label names of the backend metrics followed by extra
+func backendLabels(extra ...string) []string {
+	labels := append([]string{"pool", "backend"}, extra...)
+	for _, key := range tagKeys {
+		labels = append(labels, tagLabel(key))
+	}
+	return labels
+}
+
+// backendLabelValues returns the label values of b for the backend metrics followed by extra
+func backendLabelValues(b *Backend, extra ...string) []string {
+	values := append([]string{b.Pool(), b.URL.String()}, extra...)
+	for _, key := range tagKeys {
+		values = append(values, b.Tags[key])
+	}
+	return values
+}
+
+// unlabeledTags returns the tag keys of b which are not labels of the backend metrics
+func unlabeledTags(b *Backend) []string {
+	var keys []string
+	for key := range b.Tags {
+		known := false
+		for _, tagKey := range tagKeys {
+			known = known || key == tagKey
+		}
+		if !known {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// warnedTags are the tag keys warned about by warnUnlabeledTags
+var warnedTags sync.Map
+
+// warnUnlabeledTags warns once for each tag key of a backend added after startup which
+// the backend metrics leave out, their labels are fixed by the backends of the first router
+func warnUnlabeledTags(b *Backend) {
+	// the backends of the first router pick the labels once it is set
+	if backendRequests == nil {
+		return
+	}
+	for _, key := range unlabeledTags(b) {
+		if _, warned := warnedTags.LoadOrStore(key, true); !warned {
+			logWarnf("Tag %s of server %s is not added to the metrics, the tag labels are fixed at startup\n", key, b.URL)
+		}
+	}
+}
+
+// initMetrics registers the load balancer metrics labeled with the given tag keys
+func initMetrics(keys []string) {
+	tagKeys = keys
+	backendRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "simplelb_backend_responses_total",
+		Help: "Responses received from a backend by status code.",
+	}, backendLabels("code"))
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "simplelb_backend_errors_total",
+		Help: "Failed requests to a backend by error category.",
+	}, backendLabels("category"))
+	backendDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "simplelb_backend_request_duration_seconds",
+		Help:    "Duration of requests proxied to a backend.",
+		Buckets: prometheus.DefBuckets,
+	}, backendLabels())
+	requestSizes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "simplelb_backend_request_size_bytes",
+		Help:    "Size of the request bodies proxied to a backend.",
+		Buckets: sizeBuckets,
+	}, backendLabels())
+	responseSizes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "simplelb_backend_response_size_bytes",
+		Help:    "Size of the response bodies received from a backend.",
+		Buckets: sizeBuckets,
+	}, backendLabels())
+	throttledRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "simplelb_retries_throttled_total",
+		Help: "Retries not attempted because the retry budget was exhausted.",
+	})
+	disconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "simplelb_client_disconnects_total",
+		Help: "Requests abandoned by their client before the backend responded.",
+	})
+	retryBudgetRemaining := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "simplelb_retry_budget_remaining",
+		Help: "Retries left in the retry budget.",
+	}, func() float64 {
+		if retryBudget == nil {
+			return 0
+		}
+		return retryBudget.Remaining()
+	})
+	queueWaits = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "simplelb_queue_wait_seconds",
+		Help:    "Time requests waited for a slot of the concurrency limit before reaching a backend.",
+		Buckets: prometheus.DefBuckets,
+	})
+	queuedRequests := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "simplelb_queued_requests",
+		Help: "Requests waiting for a slot of the concurrency limit.",
+	}, func() float64 {
+		if concurrencyLimiter == nil {
+			return 0
+		}
+		return float64(concurrencyLimiter.Queued())
+	})
+	backendUpDesc = prometheus.NewDesc("simplelb_backend_up",
+		"Whether a backend is alive.", backendLabels(), nil)
+	backendConnectionsDesc = prometheus.NewDesc("simplelb_backend_active_connections",
+		"Requests in flight to a backend.", backendLabels(), nil)
+	backendWeightDesc = prometheus.NewDesc("simplelb_backend_weight",
+		"Weight of a backend.", backendLabels(), nil)
+	backendCertExpiryDesc = prometheus.NewDesc("simplelb_backend_cert_expiry_days",
+		"Days until the TLS certificate of an https backend expires.", backendLabels(), nil)
+	metricsRegistry.MustRegister(backendRequests, backendErrors, backendDurations, requestSizes, responseSizes,
+		throttledRetries, disconnects, retryBudgetRemaining, queueWaits, queuedRequests, poolCollector{})
+	// runtime metrics, such as GC pauses and heap size, to correlate with the backend latencies
+	metricsRegistry.MustRegister(collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// tagKeysOf returns the sorted tag keys used by any backend of rt,
+// keeping the first of the keys which map to the same label
+func tagKeysOf(rt *Router) []string {
+	var keys []string
+	for _, pool := range rt.Pools() {
+		for _, b := range pool.Backends() {
+			for key := range b.Tags {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	seen := make(map[string]bool)
+	unique := keys[:0]
+	for _, key := range keys {
+		if label := tagLabel(key); !seen[label] {
+			seen[label] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+// poolCollector reports the state of the backends when metrics are scraped
+type poolCollector struct{}
+
+// Describe sends no descriptions, making this an unchecked collector
+// since the backends come and go at runtime
+func (poolCollector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect reports the state of every backend
+func (poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, pool := range currentRouter().Pools() {
+		for _, b := range pool.Backends() {
+			values := backendLabelValues(b)
+			alive := 0.0
+			if b.IsAlive() {
+				alive = 1
+			}
+			ch <- prometheus.MustNewConstMetric(backendUpDesc, prometheus.GaugeValue, alive, values...)
+			ch <- prometheus.MustNewConstMetric(backendConnectionsDesc, prometheus.GaugeValue, float64(b.ActiveConnections()), values...)
+			ch <- prometheus.MustNewConstMetric(backendWeightDesc, prometheus.GaugeValue, float64(b.Weight()), values...)
+			if notAfter, ok := certExpiry(b.URL); ok {
+				days := time.Until(notAfter).Hours() / 24
+				ch <- prometheus.MustNewConstMetric(backendCertExpiryDesc, prometheus.GaugeValue, days, values...)
+			}
+		}
+	}
+}
+
+// observeResponse counts a response received from b
+func observeResponse(b *Backend, code int) {
+	backendRequests.WithLabelValues(backendLabelValues(b, strconv.Itoa(code))...).Inc()
+}
+
+// observeError counts a failed request to b
+func observeError(b *Backend, category string) {
+	backendErrors.WithLabelValues(backendLabelValues(b, category)...).Inc()
+}
+
+// observeThrottledRetry counts a retry denied by the retry budget
+func observeThrottledRetry() {
+	throttledRetries.Inc()
+}
+
+// observeClientDisconnect counts a request abandoned by its client
+func observeClientDisconnect() {
+	disconnects.Inc()
+}
+
+// observeQueueWait records how long a request waited for a slot of the concurrency limit
+func observeQueueWait(d time.Duration) {
+	queueWaits.Observe(d.Seconds())
+}
+
+// observeRequestSize records the size of a request body sent to b
+func observeRequestSize(b *Backend, n int64) {
+	requestSizes.WithLabelValues(backendLabelValues(b)...).Observe(float64(n))
+}
+
+// observeResponseSize records the size of a response body received from b
+func observeResponseSize(b *Backend, n int64) {
+	responseSizes.WithLabelValues(backendLabelValues(b)...).Observe(float64(n))
+}
+
+// countingBody counts the bytes read from a body, reporting them once it is closed
+type countingBody struct {
+	n int64 // first to keep it 64-bit aligned for atomic access
+	io.ReadCloser
+	once    sync.Once
+	observe func(n int64)
+}
+
+// countBody wraps body to report its size to observe, empty bodies are reported right away
+func countBody(body io.ReadCloser, observe func(n int64)) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		observe(0)
+		return body
+	}
+	return &countingBody{ReadCloser: body, observe: observe}
+}
+
+// Read reads from the body while counting
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// Close closes the body and reports its size
+func (c *countingBody) Close() error {
+	c.once.Do(func() { c.observe(atomic.LoadInt64(&c.n)) })
+	return c.ReadCloser.Close()
+}
+
+// traceID returns the trace id of the W3C traceparent header of r, or an empty string
+func traceID(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+		return ""
+	}
+	for _, c := range parts[1] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return ""
+		}
+	}
+	return parts[1]
+}
+
+// observeDuration records the duration of a request proxied to b,
+// attaching the trace id of the request as an exemplar when it has one
+func observeDuration(b *Backend, r *http.Request, elapsed time.Duration) {
+	observer := backendDurations.WithLabelValues(backendLabelValues(b)...)
+	if id := traceID(r); id != "" {
+		if eo, ok := observer.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(elapsed.Seconds(), prometheus.Labels{"trace_id": id})
+			return
+		}
+	}
+	observer.Observe(elapsed.Seconds())
+}
+
+// metricsHandler serves the metrics in the prometheus exposition format,
+// or in the OpenMetrics format carrying the exemplars when the scraper asks for it
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
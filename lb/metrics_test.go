@@ -0,0 +1,78 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClientDisconnectIsNotABackendFailure(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	c := DefaultConfig()
+	c.EjectFailures = 1
+	server, pool := serveBackends(t, c, backend.URL)
+	defer server.Close()
+	defer Configure(DefaultConfig())
+	b := pool.Backends()[0]
+
+	backendErrorCount := func() float64 {
+		var n float64
+		for _, category := range errorCategories {
+			n += testutil.ToFloat64(backendErrors.WithLabelValues(backendLabelValues(b, category)...))
+		}
+		return n
+	}
+	errorsBefore, disconnectsBefore := backendErrorCount(), testutil.ToFloat64(disconnects)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-arrived
+		cancel()
+	}()
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	if _, err := server.Client().Do(req.WithContext(ctx)); err == nil {
+		t.Fatal("request of a client which went away succeeded")
+	}
+
+	// the load balancer notices the disconnect on its own time
+	for deadline := time.Now().Add(2 * time.Second); testutil.ToFloat64(disconnects) == disconnectsBefore && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(disconnects) - disconnectsBefore; got != 1 {
+		t.Errorf("disconnects counted %v, want 1", got)
+	}
+	if got := backendErrorCount() - errorsBefore; got != 0 {
+		t.Errorf("backend errors counted %v, want none", got)
+	}
+	if score := b.failures.Score(time.Now(), cfg.EjectWindow); score != 0 {
+		t.Errorf("failure score %v, want 0", score)
+	}
+	if !b.IsAlive() {
+		t.Error("backend ejected for a client going away")
+	}
+}
+
+func TestUnlabeledTags(t *testing.T) {
+	saved := tagKeys
+	defer func() { tagKeys = saved }()
+	tagKeys = []string{"rack", "zone"}
+
+	b := testBackends(t, 1)[0]
+	b.Tags = map[string]string{"zone": "us-east-1a", "version": "2", "canary": "true"}
+	if got := unlabeledTags(b); len(got) != 2 || got[0] != "canary" || got[1] != "version" {
+		t.Errorf("unlabeledTags = %v, want [canary version] left out of the metrics", got)
+	}
+	b.Tags = map[string]string{"zone": "us-east-1a"}
+	if got := unlabeledTags(b); len(got) != 0 {
+		t.Errorf("unlabeledTags = %v, want none for the tags known at startup", got)
+	}
+}
@@ -0,0 +1,93 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// shadowTimeout bounds a mirrored request to the shadow backend
+const shadowTimeout = 30 * time.Second
+
+// maxShadowRequests caps the mirrored requests in flight, further requests are not mirrored
+const maxShadowRequests = 100
+
+// Mirror copies requests to a shadow backend without affecting the client
+type Mirror struct {
+	URL      *url.URL
+	MaxBody  int64
+	inFlight chan struct{}
+}
+
+// NewMirror creates a mirror to the shadow backend at u buffering bodies up to maxBody bytes
+func NewMirror(u *url.URL, maxBody int64) *Mirror {
+	return &Mirror{
+		URL:      u,
+		MaxBody:  maxBody,
+		inFlight: make(chan struct{}, maxShadowRequests),
+	}
+}
+
+// Send fires a copy of r at the shadow backend in the background.
+// The body of r is buffered so both the client path and the shadow can read it,
+// requests with larger bodies or protocol upgrades are not mirrored
+func (m *Mirror) Send(r *http.Request) {
+	if r.Header.Get("Upgrade") != "" {
+		return
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		buf, err := ioutil.ReadAll(io.LimitReader(r.Body, m.MaxBody+1))
+		// give the client path back everything read so far followed by the rest
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		if err != nil || int64(len(buf)) > m.MaxBody {
+			return
+		}
+		body = buf
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		logWarnf("%s(%s) Too many shadow requests in flight, not mirroring\n", r.RemoteAddr, r.URL.Path)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	shadow := r.Clone(ctx)
+	shadow.RequestURI = ""
+	shadow.URL.Scheme = m.URL.Scheme
+	shadow.URL.Host = m.URL.Host
+	shadow.URL.Path = singleJoiningSlash(m.URL.Path, r.URL.Path)
+	shadow.Host = m.URL.Host
+	shadow.Body = http.NoBody
+	shadow.ContentLength = int64(len(body))
+	if len(body) > 0 {
+		shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	go func() {
+		defer func() { <-m.inFlight }()
+		defer cancel()
+		resp, err := transport.RoundTrip(shadow)
+		if err != nil {
+			logWarnf("[%s] shadow category=%s error=%q\n", m.URL.Host, classifyError(err), err.Error())
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// readCloser reads from one reader and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var mirror *Mirror
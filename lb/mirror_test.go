@@ -0,0 +1,48 @@
+package lb_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kasvith/simplelb/lb"
+	"github.com/kasvith/simplelb/lb/lbtest"
+)
+
+func TestMirrorSkipsRejectedRequests(t *testing.T) {
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Method
+	}))
+	defer shadow.Close()
+	backend := lbtest.NewBackend()
+	defer backend.Close()
+
+	c := lb.DefaultConfig()
+	c.Shadow = shadow.URL
+	c.AllowedMethods = lb.Methods{http.MethodGet: true}
+	l, err := lbtest.Start(c, &lb.RoundRobin{}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, method := range []string{http.MethodDelete, http.MethodGet} {
+		req, _ := http.NewRequest(method, l.URL+"/", nil)
+		resp, err := l.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// the rejected request would have been mirrored before the allowed one
+	select {
+	case method := <-mirrored:
+		if method != http.MethodGet {
+			t.Errorf("shadow got a %s rejected with 405", method)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("allowed request not mirrored")
+	}
+}
@@ -0,0 +1,77 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// RoutePolicy overrides the global timeouts and retries for the requests of a route,
+// a zero RoutePolicy keeps the globals
+type RoutePolicy struct {
+	// Timeout replaces -total-timeout, bounding the request with every retry and failover
+	Timeout time.Duration
+	// MaxAttempts caps the times a request is sent to a backend, retries and failovers
+	// included, so 1 never retries. Zero keeps the default of 3 retries on 3 backends
+	MaxAttempts int
+	// RetryOn replaces -retry-on when not nil, an empty set retries on no status
+	RetryOn StatusCodes
+}
+
+// IsZero returns true when the policy overrides nothing
+func (p RoutePolicy) IsZero() bool {
+	return p.Timeout == 0 && p.MaxAttempts == 0 && p.RetryOn == nil
+}
+
+// requestPolicy is the policy of a request in flight along with the times it was sent
+type requestPolicy struct {
+	RoutePolicy
+	tries int32
+}
+
+// withPolicy returns r carrying the policy of its route, r itself when it has none
+func withPolicy(r *http.Request, policy RoutePolicy) *http.Request {
+	if policy.IsZero() {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), policyKey, &requestPolicy{RoutePolicy: policy}))
+}
+
+// policyOf returns the policy of the route of r, nil when it has none
+func policyOf(r *http.Request) *requestPolicy {
+	policy, _ := r.Context().Value(policyKey).(*requestPolicy)
+	return policy
+}
+
+// totalTimeout returns the timeout of r with every retry and failover, zero for none
+func totalTimeout(r *http.Request) time.Duration {
+	if policy := policyOf(r); policy != nil && policy.Timeout > 0 {
+		return policy.Timeout
+	}
+	return cfg.TotalTimeout
+}
+
+// countSend counts r being sent to a backend towards the max attempts of its route
+func countSend(r *http.Request) {
+	if policy := policyOf(r); policy != nil && policy.MaxAttempts > 0 {
+		atomic.AddInt32(&policy.tries, 1)
+	}
+}
+
+// attemptsLeft returns false once r was sent to a backend as often as its route allows
+func attemptsLeft(r *http.Request) bool {
+	policy := policyOf(r)
+	if policy == nil || policy.MaxAttempts <= 0 {
+		return true
+	}
+	return int(atomic.LoadInt32(&policy.tries)) < policy.MaxAttempts
+}
+
+// retryOnStatus returns true when a backend response with the status code is retried for r
+func retryOnStatus(r *http.Request, code int) bool {
+	if policy := policyOf(r); policy != nil && policy.RetryOn != nil {
+		return policy.RetryOn[code]
+	}
+	return cfg.RetryOn[code]
+}
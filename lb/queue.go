@@ -0,0 +1,59 @@
+package lb
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// queueWaitHeader is the response header holding how long a request was queued
+const queueWaitHeader = "X-Simplelb-Queue-Wait"
+
+// ConcurrencyLimiter bounds the requests served at once, queueing the others until a
+// slot frees up or their timeout runs out
+type ConcurrencyLimiter struct {
+	Timeout time.Duration
+	slots   chan struct{}
+	queued  int64
+}
+
+// NewConcurrencyLimiter creates a limiter serving max requests at once, queueing
+// others for up to timeout
+func NewConcurrencyLimiter(max int, timeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{Timeout: timeout, slots: make(chan struct{}, max)}
+}
+
+// Acquire waits for a slot, returning how long it waited and false when the timeout
+// ran out or ctx was done first
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) (time.Duration, bool) {
+	select {
+	case l.slots <- struct{}{}:
+		return 0, true
+	default:
+	}
+
+	start := time.Now()
+	atomic.AddInt64(&l.queued, 1)
+	defer atomic.AddInt64(&l.queued, -1)
+	timer := time.NewTimer(l.Timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return time.Since(start), true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return time.Since(start), false
+}
+
+// Release gives back a slot taken by Acquire
+func (l *ConcurrencyLimiter) Release() {
+	<-l.slots
+}
+
+// Queued returns the number of requests waiting for a slot
+func (l *ConcurrencyLimiter) Queued() int64 {
+	return atomic.LoadInt64(&l.queued)
+}
+
+var concurrencyLimiter *ConcurrencyLimiter
@@ -0,0 +1,219 @@
+package lb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisTimeout bounds a round trip to redis
+const redisTimeout = time.Second
+
+// redisSlotTTL is how long the concurrency slots of a key outlive its last request,
+// so slots held by a load balancer which went away are given back eventually
+const redisSlotTTL = time.Hour
+
+// maxIdleRedisConns is the number of idle redis connections kept for reuse
+const maxIdleRedisConns = 16
+
+// redisKeyPrefix namespaces the keys of the load balancer in a shared redis
+const redisKeyPrefix = "simplelb:"
+
+// RedisLimitStore is a LimitStore in redis, shared by the load balancers using it
+type RedisLimitStore struct {
+	Addr     string
+	Password string
+	DB       int
+	idle     chan *redisConn
+}
+
+// NewRedisLimitStore creates a limit store for the redis://[:password@]host:port[/db] url rawurl
+func NewRedisLimitStore(rawurl string) (*RedisLimitStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid limit store %q, expected memory or a redis url", redactURLs(rawurl))
+	}
+
+	s := &RedisLimitStore{Addr: u.Host, idle: make(chan *redisConn, maxIdleRedisConns)}
+	if u.Port() == "" {
+		s.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		// redis://:password@host as well as redis://password@host
+		if password, ok := u.User.Password(); ok {
+			s.Password = password
+		} else {
+			s.Password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.DB, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return s, nil
+}
+
+// acquireScript takes a slot of KEYS[1] unless all ARGV[1] are taken, refreshing its
+// expiry of ARGV[2] milliseconds. Redis runs it atomically, so no failure leaves a slot
+// counted which was not handed out
+const acquireScript = `local n = redis.call('INCR', KEYS[1])
+if n > tonumber(ARGV[1]) then
+	redis.call('DECR', KEYS[1])
+	return 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1`
+
+// Acquire takes a slot of key, giving it back right away when all were taken. A reply
+// lost on the way back leaves the slot taken until the key expires after redisSlotTTL
+func (s *RedisLimitStore) Acquire(key string, max int) (bool, error) {
+	replies, err := s.do([]string{
+		"EVAL", acquireScript, "1", redisKeyPrefix + key,
+		strconv.Itoa(max), strconv.FormatInt(int64(redisSlotTTL/time.Millisecond), 10),
+	})
+	if err != nil {
+		return false, err
+	}
+	return replies[0] == 1, nil
+}
+
+// releaseScript gives back a slot of KEYS[1] unless none is counted, as after the key
+// expired while the slot was taken, so a late release cannot hand out an extra slot
+const releaseScript = `local n = redis.call('GET', KEYS[1])
+if n and tonumber(n) > 0 then
+	redis.call('DECR', KEYS[1])
+end
+return 0`
+
+// Release gives back a slot of key
+func (s *RedisLimitStore) Release(key string) error {
+	_, err := s.do([]string{"EVAL", releaseScript, "1", redisKeyPrefix + key})
+	return err
+}
+
+// Allow counts a request of key in a fixed window, the counters of past windows expire
+func (s *RedisLimitStore) Allow(key string, limit int, window time.Duration) (bool, error) {
+	start := time.Now().UnixNano() / int64(window)
+	key = redisKeyPrefix + key + ":" + strconv.FormatInt(start, 10)
+	replies, err := s.do(
+		[]string{"INCR", key},
+		[]string{"PEXPIRE", key, strconv.FormatInt(int64(2*window/time.Millisecond)+1, 10)},
+	)
+	if err != nil {
+		return false, err
+	}
+	return replies[0] <= int64(limit), nil
+}
+
+// do sends cmds in a single round trip and returns their integer replies
+func (s *RedisLimitStore) do(cmds ...[]string) ([]int64, error) {
+	var conn *redisConn
+	select {
+	case conn = <-s.idle:
+	default:
+		var err error
+		if conn, err = s.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := conn.do(cmds)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("redis %s: %v", s.Addr, err)
+	}
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return replies, nil
+}
+
+// dial opens a connection to redis, authenticated and on the configured database
+func (s *RedisLimitStore) dial() (*redisConn, error) {
+	c, err := net.DialTimeout("tcp", s.Addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: c, r: bufio.NewReader(c)}
+
+	var setup [][]string
+	if s.Password != "" {
+		setup = append(setup, []string{"AUTH", s.Password})
+	}
+	if s.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.DB)})
+	}
+	if len(setup) > 0 {
+		if _, err := conn.do(setup); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis %s: %v", s.Addr, err)
+		}
+	}
+	return conn, nil
+}
+
+// redisConn is a connection speaking the redis protocol
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do writes cmds and reads a reply for each of them, status replies read as 0
+func (c *redisConn) do(cmds [][]string) ([]int64, error) {
+	if err := c.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	for _, args := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+
+	// read every reply so the connection stays in sync after an error reply
+	replies := make([]int64, len(cmds))
+	var replyErr error
+	for i := range cmds {
+		n, err := c.readReply()
+		if err != nil && replyErr == nil {
+			replyErr = err
+		}
+		replies[i] = n
+	}
+	return replies, replyErr
+}
+
+// readReply reads an integer, status or error reply
+func (c *redisConn) readReply() (int64, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return 0, errors.New("empty reply")
+	}
+	switch line[0] {
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '+':
+		return 0, nil
+	case '-':
+		return 0, errors.New(line[1:])
+	}
+	return 0, fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,36 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisReleaseAfterTheSlotsExpired(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	store, err := NewRedisLimitStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := store.Acquire("conn:client", 1); err != nil || !ok {
+		t.Fatalf("Acquire = %v, %v, want the free slot", ok, err)
+	}
+	// the slots of a load balancer which went away expire, its release comes too late
+	server.FastForward(redisSlotTTL + time.Second)
+	if err := store.Release("conn:client"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := store.Acquire("conn:client", 1); err != nil || !ok {
+		t.Fatalf("Acquire = %v, %v, want the free slot", ok, err)
+	}
+	if ok, err := store.Acquire("conn:client", 1); err != nil || ok {
+		t.Errorf("Acquire = %v, %v, want no extra slot after the late release", ok, err)
+	}
+}
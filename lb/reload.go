@@ -0,0 +1,67 @@
+package lb
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// listenFdsEnv names the listeners passed to a reloaded process, in the order of their fds from 3
+	listenFdsEnv = "SIMPLELB_LISTEN_FDS"
+	// readyFdEnv holds the fd a reloaded process writes to once it serves
+	readyFdEnv = "SIMPLELB_READY_FD"
+)
+
+// reloadTimeout bounds how long a reload waits for the new process and for the old one to drain
+const reloadTimeout = 30 * time.Second
+
+// inherited are the listeners passed on by the process which was reloaded
+var inherited = make(map[string]net.Listener)
+
+// listeners are the listeners of this process by name, handed over on reload
+var listeners = make(map[string]net.Listener)
+
+// inheritListeners takes over the listeners passed on by the process which was reloaded
+func inheritListeners() {
+	names := os.Getenv(listenFdsEnv)
+	if names == "" {
+		return
+	}
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			logWarnf("Failed to inherit listener %s, error=%q\n", name, err.Error())
+			continue
+		}
+		inherited[name] = ln
+	}
+}
+
+// listen returns the listener inherited under name, or listens on addr
+func listen(name, addr string) (net.Listener, error) {
+	ln, ok := inherited[name]
+	if !ok {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	listeners[name] = ln
+	return ln, nil
+}
+
+// notifyReady tells the process which was reloaded that this one serves now
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyFdEnv))
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
@@ -0,0 +1,121 @@
+//go:build !windows
+// +build !windows
+
+package lb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// handleReloadSignal starts a new process taking over the listeners whenever SIGUSR2
+// is received, then calls shutdown to drain this process. It returns once ctx is done
+func handleReloadSignal(ctx context.Context, shutdown func(ctx context.Context)) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-sig:
+		case <-ctx.Done():
+			return
+		}
+		logInfof("Reloading, starting a new process\n")
+		if err := handoff(); err != nil {
+			logErrorf("Reload failed, keeping this process, error=%q\n", err.Error())
+			continue
+		}
+		logInfof("Reloaded, draining connections\n")
+		drainCtx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+		shutdown(drainCtx)
+		cancel()
+		return
+	}
+}
+
+// handoff starts a copy of this process with the same arguments which inherits the
+// listeners, returning once it serves
+func handoff() error {
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range names {
+		tcp, ok := listeners[name].(*net.TCPListener)
+		if !ok {
+			return errors.New("listener " + name + " can not be handed over")
+		}
+		f, err := tcp.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		notify.Close()
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, notify)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, listenFdsEnv+"=") && !strings.HasPrefix(env, readyFdEnv+"=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		listenFdsEnv+"="+strings.Join(names, ","),
+		readyFdEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	notify.Close()
+	if err != nil {
+		return err
+	}
+
+	// the pipe closes without a byte when the new process exits before serving
+	done := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if n, _ := ready.Read(b); n == 0 {
+			done <- errors.New("new process exited before serving")
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(reloadTimeout):
+		err = errors.New("new process did not serve in time")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	return err
+}
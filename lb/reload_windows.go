@@ -0,0 +1,6 @@
+package lb
+
+import "context"
+
+// handleReloadSignal does nothing since windows can not pass listeners to a new process
+func handleReloadSignal(ctx context.Context, shutdown func(ctx context.Context)) {}
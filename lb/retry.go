@@ -0,0 +1,90 @@
+package lb
+
+import (
+	"sync"
+	"time"
+)
+
+// retryBudgetWindow is the sliding window over which the retry budget is measured
+const retryBudgetWindow = 10 * time.Second
+
+// retryBudgetBuckets splits the window into buckets which expire one at a time
+const retryBudgetBuckets = 10
+
+// retryBucket counts the requests and retries of one slice of the window
+type retryBucket struct {
+	start    int64
+	requests int
+	retries  int
+}
+
+// RetryBudget caps retries to a fraction of the requests over a sliding window so a
+// struggling backend is not buried by a storm of retries, Min retries are always allowed
+type RetryBudget struct {
+	Ratio   float64
+	Min     int
+	mux     sync.Mutex
+	buckets [retryBudgetBuckets]retryBucket
+}
+
+// NewRetryBudget creates a budget allowing min retries plus ratio of the requests in the window
+func NewRetryBudget(ratio float64, min int) *RetryBudget {
+	return &RetryBudget{Ratio: ratio, Min: min}
+}
+
+// bucket returns the bucket of now, resetting it when it held an expired slice
+func (rb *RetryBudget) bucket(now time.Time) *retryBucket {
+	slice := int64(retryBudgetWindow / retryBudgetBuckets)
+	start := now.UnixNano() / slice
+	b := &rb.buckets[start%retryBudgetBuckets]
+	if b.start != start {
+		*b = retryBucket{start: start}
+	}
+	return b
+}
+
+// totals sums the requests and retries in the window ending at now
+func (rb *RetryBudget) totals(now time.Time) (requests, retries int) {
+	oldest := now.UnixNano()/int64(retryBudgetWindow/retryBudgetBuckets) - retryBudgetBuckets
+	for _, b := range rb.buckets {
+		if b.start > oldest {
+			requests += b.requests
+			retries += b.retries
+		}
+	}
+	return requests, retries
+}
+
+// Request counts a client request towards the budget
+func (rb *RetryBudget) Request() {
+	rb.mux.Lock()
+	rb.bucket(time.Now()).requests++
+	rb.mux.Unlock()
+}
+
+// Withdraw takes a retry out of the budget, returning false when it is exhausted
+func (rb *RetryBudget) Withdraw() bool {
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+	now := time.Now()
+	if rb.remaining(now) < 1 {
+		return false
+	}
+	rb.bucket(now).retries++
+	return true
+}
+
+// remaining returns the retries left in the window ending at now
+func (rb *RetryBudget) remaining(now time.Time) float64 {
+	requests, retries := rb.totals(now)
+	return float64(rb.Min) + rb.Ratio*float64(requests) - float64(retries)
+}
+
+// Remaining returns the retries currently left in the budget
+func (rb *RetryBudget) Remaining() float64 {
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+	return rb.remaining(time.Now())
+}
+
+var retryBudget *RetryBudget
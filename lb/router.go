@@ -0,0 +1,158 @@
+package lb
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultPool is the pool of the -backends servers, serving requests that match no route
+const DefaultPool = "default"
+
+// Route sends the requests whose path matches Pattern and whose body matches Body to Pool,
+// with the timeouts and retries of Policy
+type Route struct {
+	Pattern *regexp.Regexp
+	Body    BodyMatch
+	Pool    *ServerPool
+	Policy  RoutePolicy
+}
+
+// BodyMatch matches requests by their body, a zero BodyMatch matches every request
+type BodyMatch struct {
+	// MinContentLength is the smallest Content-Length matched, requests of
+	// unknown length such as chunked ones never match a minimum
+	MinContentLength int64
+	// ContentType is the media type matched, such as video/mp4, or a type
+	// followed by /* such as video/*
+	ContentType string
+}
+
+// Matches returns true when the body of r matches
+func (m BodyMatch) Matches(r *http.Request) bool {
+	if m.MinContentLength > 0 && r.ContentLength < m.MinContentLength {
+		return false
+	}
+	if m.ContentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(m.ContentType, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(m.ContentType, "*"))
+	}
+	return mediaType == m.ContentType
+}
+
+// Router holds the server pools and the ordered routes to them
+type Router struct {
+	pools  map[string]*ServerPool
+	routes []Route
+}
+
+// NewRouter creates a router without pools or routes
+func NewRouter() *Router {
+	return &Router{pools: make(map[string]*ServerPool)}
+}
+
+// AddPool registers a pool with the router
+func (rt *Router) AddPool(pool *ServerPool) {
+	rt.pools[pool.Name()] = pool
+}
+
+// Pool returns the pool with the given name or nil
+func (rt *Router) Pool(name string) *ServerPool {
+	return rt.pools[name]
+}
+
+// Pools returns all the pools ordered by name
+func (rt *Router) Pools() []*ServerPool {
+	pools := make([]*ServerPool, 0, len(rt.pools))
+	for _, pool := range rt.pools {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name() < pools[j].Name()
+	})
+	return pools
+}
+
+// AddRoute appends a route for the path pattern and body to the named pool
+func (rt *Router) AddRoute(pattern string, body BodyMatch, poolName string) error {
+	return rt.AddRouteWithPolicy(pattern, body, poolName, RoutePolicy{})
+}
+
+// AddRouteWithPolicy appends a route for the path pattern and body to the named pool,
+// overriding the global timeouts and retries with policy
+func (rt *Router) AddRouteWithPolicy(pattern string, body BodyMatch, poolName string, policy RoutePolicy) error {
+	pool := rt.Pool(poolName)
+	if pool == nil {
+		return fmt.Errorf("route %q refers to unknown pool %q", pattern, poolName)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid route pattern %q: %v", pattern, err)
+	}
+	body.ContentType = strings.ToLower(body.ContentType)
+	rt.routes = append(rt.routes, Route{Pattern: re, Body: body, Pool: pool, Policy: policy})
+	return nil
+}
+
+// Routes returns the routes in the order they are evaluated
+func (rt *Router) Routes() []Route {
+	routes := make([]Route, len(rt.routes))
+	copy(routes, rt.routes)
+	return routes
+}
+
+// Match returns the pool of the first route matching the request,
+// falling back to the default pool
+func (rt *Router) Match(r *http.Request) *ServerPool {
+	if route := rt.MatchRoute(r); route != nil {
+		return route.Pool
+	}
+	return rt.Pool(DefaultPool)
+}
+
+// MatchRoute returns the first route matching the request, nil when none does
+func (rt *Router) MatchRoute(r *http.Request) *Route {
+	for i := range rt.routes {
+		if rt.routes[i].Pattern.MatchString(r.URL.Path) && rt.routes[i].Body.Matches(r) {
+			return &rt.routes[i]
+		}
+	}
+	return nil
+}
+
+// router holds the *Router requests are load balanced over, replaced whole by SetRouter
+// while requests and the admin api read it
+var router atomic.Value
+
+// noRouter is in effect until a router is set
+var noRouter = NewRouter()
+
+// currentRouter returns the router in effect
+func currentRouter() *Router {
+	rt, _ := router.Load().(*Router)
+	if rt == nil {
+		return noRouter
+	}
+	return rt
+}
+
+// metricsOnce registers the metrics along with the first router
+var metricsOnce sync.Once
+
+// SetRouter sets the pools and routes requests are load balanced over. The backend
+// metrics are labeled with the tags of the backends of the first router set
+func SetRouter(rt *Router) {
+	metricsOnce.Do(func() { initMetrics(tagKeysOf(rt)) })
+	router.Store(rt)
+}
@@ -0,0 +1,311 @@
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Configure validates c and sets it as the config of the load balancer, along with the
+// state derived from it such as the client limits and the backend transport. Call it
+// once before creating any backend
+func Configure(c Config) error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("please provide both a TLS certificate and key")
+	}
+	if len(c.Autocert) > 0 && c.TLSCert != "" {
+		return errors.New("please provide either a TLS certificate or autocert domains")
+	}
+	if (len(c.TLSCiphers) > 0 || c.TLSClientCA != "") && c.TLSCert == "" && len(c.Autocert) == 0 {
+		return errors.New("please provide a TLS certificate or autocert domains along with the cipher suites or client CA")
+	}
+	if c.AdminPassword != "" && c.AdminUser == "" {
+		return errors.New("please provide an admin user along with the admin password")
+	}
+	if c.AdminUser != "" && c.AdminPassword == "" {
+		return errors.New("please provide an admin password along with the admin user")
+	}
+	if c.SelfTest && !strings.HasPrefix(c.SelfTestPath, "/") {
+		return errors.New("please provide a self-test path starting with a slash")
+	}
+	if c.BasePath != "" && !strings.HasPrefix(c.BasePath, "/") {
+		return errors.New("please provide a base path starting with a slash")
+	}
+	c.BasePath = strings.TrimSuffix(c.BasePath, "/")
+
+	if c.RoundRobinStart < 0 {
+		return errors.New("please provide a round robin start of zero or more")
+	}
+	if c.BackendOrderSeed == 0 {
+		c.BackendOrderSeed = time.Now().UnixNano()
+	}
+	cfg = c
+
+	clientACL, err := NewACL(cfg.Allow, cfg.Deny)
+	if err != nil {
+		return err
+	}
+	setACL(clientACL)
+
+	if err := validateDurations(); err != nil {
+		return err
+	}
+	if err := parseTLSSettings(); err != nil {
+		return err
+	}
+	if cfg.HealthCheckJitter < 0 || cfg.HealthCheckJitter >= healthCheckInterval {
+		return fmt.Errorf("please provide a health check jitter below the health check interval of %s", healthCheckInterval)
+	}
+	if cfg.ZoneSpillover < 0 || cfg.ZoneSpillover > 1 {
+		return errors.New("please provide a zone spillover between 0 and 1")
+	}
+	if err := validateProxy(cfg.UpstreamProxy); err != nil {
+		return err
+	}
+	if cfg.EjectFailures < 0 {
+		return errors.New("please provide a non negative number of eject failures")
+	}
+	if cfg.LimitIPv4Prefix < 0 || cfg.LimitIPv4Prefix > 32 || cfg.LimitIPv6Prefix < 0 || cfg.LimitIPv6Prefix > 128 {
+		return errors.New("please provide limit prefixes of at most 32 bits for IPv4 and 128 bits for IPv6")
+	}
+	if cfg.MaxClientRequests < 0 {
+		return errors.New("please provide a non negative max client requests")
+	}
+	retryBudget = nil
+	if cfg.RetryBudget >= 0 {
+		retryBudget = NewRetryBudget(cfg.RetryBudget, cfg.RetryBudgetMin)
+	}
+	if cfg.RateLimit < 0 || cfg.RateLimitWindow <= 0 {
+		return errors.New("please provide a non negative rate limit and a positive rate limit window")
+	}
+	clientLimiter = nil
+	if cfg.MaxClientRequests > 0 || cfg.RateLimit > 0 {
+		store, err := newLimitStore(cfg.LimitStore)
+		if err != nil {
+			return err
+		}
+		clientLimiter = NewClientLimiter(cfg.MaxClientRequests, cfg.RateLimit, cfg.RateLimitWindow, store)
+	}
+	if stickySameSite, err = parseSameSite(cfg.StickyCookieSameSite); err != nil {
+		return err
+	}
+	if stickySameSite == http.SameSiteNoneMode && !cfg.StickyCookieSecure {
+		return errors.New("please provide -sticky-cookie-secure along with a SameSite of none")
+	}
+	if connectPorts, err = parseConnectPorts(cfg.ForwardProxyPorts); err != nil {
+		return err
+	}
+	if cfg.MaxHeaderBytes <= 0 {
+		return errors.New("please provide a positive max header bytes")
+	}
+	if cfg.RetryBodyMax < 0 {
+		return errors.New("please provide a non negative retry body max")
+	}
+	if cfg.ProxyBufferSize <= 0 {
+		return errors.New("please provide a positive proxy buffer size")
+	}
+	proxyBuffers = NewBufferPool(cfg.ProxyBufferSize)
+	if cfg.WarmConnections < 0 {
+		return errors.New("please provide a non negative number of warm connections")
+	}
+	if cfg.MaxConcurrentRequests < 0 {
+		return errors.New("please provide a non negative max concurrent requests")
+	}
+	concurrencyLimiter = nil
+	if cfg.MaxConcurrentRequests > 0 {
+		concurrencyLimiter = NewConcurrencyLimiter(cfg.MaxConcurrentRequests, cfg.QueueTimeout)
+	}
+	transport = newTransport()
+
+	for _, path := range cfg.DirectorPlugins {
+		if err := loadDirectorPlugin(path); err != nil {
+			return err
+		}
+		logInfof("Loaded director plugin: %s\n", path)
+	}
+
+	mirror = nil
+	if cfg.Shadow != "" {
+		shadowUrl, err := url.Parse(cfg.Shadow)
+		if err != nil || shadowUrl.Scheme == "" || shadowUrl.Host == "" {
+			return fmt.Errorf("invalid shadow backend %q", cfg.Shadow)
+		}
+		mirror = NewMirror(shadowUrl, cfg.ShadowMaxBody)
+		logInfof("Mirroring requests to shadow server: %s\n", shadowUrl)
+	}
+	return nil
+}
+
+// Main runs the load balancer command with the config c and the backends given on the
+// command line, it exits the process on errors
+func Main(c Config, backends []string) {
+	if len(backends) == 0 && c.ConfigFile == "" {
+		log.Fatal("Please provide one or more backends to load balance")
+	}
+	if err := Configure(c); err != nil {
+		log.Fatal(err)
+	}
+
+	fc := &FileConfig{}
+	if cfg.ConfigFile != "" {
+		var err error
+		if fc, err = loadFileConfig(cfg.ConfigFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(backends) > 0 {
+		if fc.Pools == nil {
+			fc.Pools = make(map[string]PoolConfig)
+		}
+		pc := fc.Pools[DefaultPool]
+		for _, tok := range backends {
+			pc.Backends = append(pc.Backends, BackendConfig{URL: tok})
+		}
+		fc.Pools[DefaultPool] = pc
+	}
+
+	if problems := validateFileConfig(fc); len(problems) > 0 {
+		for _, problem := range problems {
+			logWarnf("Config problem: %s\n", problem)
+		}
+		if cfg.Strict {
+			log.Fatal("Refusing to start with config problems in strict mode")
+		}
+	}
+
+	rt, err := buildRouter(fc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	SetRouter(rt)
+
+	// create http server
+	server := http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           Handler(),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	if cfg.TLSCert != "" {
+		// certificates rotated on disk are picked up without a restart
+		certs, err := NewCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = newServerTLSConfig(certs.GetCertificate)
+		goBackground(func(ctx context.Context) { certs.Run(ctx, certReloadInterval) })
+	}
+	var certManager *autocert.Manager
+	if len(cfg.Autocert) > 0 {
+		certManager = newCertManager()
+		server.TLSConfig = newServerTLSConfig(certManager.GetCertificate)
+	}
+	if cfg.Check {
+		logInfof("Config is valid\n")
+		return
+	}
+	if cfg.SelfTest {
+		if failed := SelfTest(); failed > 0 {
+			log.Fatalf("Self-test failed for %d backends", failed)
+		}
+		logInfof("Self-test passed\n")
+		return
+	}
+	if cfg.DisableKeepAlive {
+		server.SetKeepAlivesEnabled(false)
+	}
+	if !cfg.HTTP2 {
+		// a non nil map keeps the server from negotiating h2 over ALPN
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	// start health checking, the weight schedules and adaptive weights
+	Start()
+
+	// dump diagnostics on SIGUSR1
+	goBackground(handleDiagnosticsSignal)
+
+	// take over the listeners of the process being reloaded, if any
+	inheritListeners()
+
+	// start admin api
+	var adminServer *http.Server
+	if cfg.AdminAddr != "" {
+		adminListener, err := listen("admin", cfg.AdminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		adminServer = newAdminServer(cfg.AdminAddr)
+		// event streams would otherwise hold up draining the admin api
+		adminServer.RegisterOnShutdown(events.Close)
+		go serveAdmin(adminServer, adminListener)
+	}
+
+	// answer the ACME challenges of autocert
+	var challengeServer *http.Server
+	if certManager != nil {
+		challengeListener, err := listen("acme", cfg.AutocertHTTPAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		challengeServer = newChallengeServer(certManager)
+		go serveChallenges(challengeServer, challengeListener)
+	}
+
+	listener, err := listen("lb", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.ProxyProtocol {
+		listener = ProxyProtoListener{Listener: listener, Timeout: cfg.ReadHeaderTimeout}
+	}
+
+	// hand the listeners over to a new process on SIGUSR2 or stop on SIGINT and SIGTERM,
+	// draining this one and ending the background goroutines
+	drained := make(chan struct{})
+	var once sync.Once
+	shutdown := func(ctx context.Context) {
+		once.Do(func() {
+			if adminServer != nil {
+				adminServer.Shutdown(ctx)
+			}
+			if challengeServer != nil {
+				challengeServer.Shutdown(ctx)
+			}
+			server.Shutdown(ctx)
+			// the signal handlers are background goroutines too, Stop must not wait on the caller
+			go func() {
+				Stop()
+				close(drained)
+			}()
+		})
+	}
+	goBackground(func(ctx context.Context) { handleReloadSignal(ctx, shutdown) })
+	goBackground(func(ctx context.Context) { handleShutdownSignal(ctx, shutdown) })
+	notifyReady()
+
+	if server.TLSConfig != nil {
+		logInfof("Load Balancer started at :%d with TLS\n", cfg.Port)
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		logInfof("Load Balancer started at :%d\n", cfg.Port)
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-drained
+}
@@ -0,0 +1,112 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// weightScheduleInterval is how often the weight schedules are applied, and so the step size of ramps
+const weightScheduleInterval = 10 * time.Second
+
+// weightStep sets the weight of a backend at a point in time
+type weightStep struct {
+	at     time.Time
+	weight int
+	ramp   bool
+}
+
+// WeightSchedule changes the weight of a backend over time, steps are in ascending order
+type WeightSchedule []weightStep
+
+// newWeightSchedule builds the schedule described by steps, durations are relative to start
+func newWeightSchedule(steps []WeightStepConfig, start time.Time) (WeightSchedule, error) {
+	schedule := make(WeightSchedule, 0, len(steps))
+	for i, sc := range steps {
+		var step weightStep
+		switch {
+		case sc.At != "" && sc.After != "":
+			return nil, fmt.Errorf("schedule step %d has both at and after", i)
+		case sc.At != "":
+			at, err := time.Parse(time.RFC3339, sc.At)
+			if err != nil {
+				return nil, fmt.Errorf("schedule step %d: %v", i, err)
+			}
+			step.at = at
+		case sc.After != "":
+			after, err := time.ParseDuration(sc.After)
+			if err != nil {
+				return nil, fmt.Errorf("schedule step %d: %v", i, err)
+			}
+			step.at = start.Add(after)
+		default:
+			return nil, fmt.Errorf("schedule step %d needs at or after", i)
+		}
+		if sc.Weight < 0 {
+			return nil, fmt.Errorf("schedule step %d has a negative weight", i)
+		}
+		if i > 0 && !step.at.After(schedule[i-1].at) {
+			return nil, errors.New("schedule steps must be in ascending order")
+		}
+		step.weight = sc.Weight
+		step.ramp = sc.Ramp
+		schedule = append(schedule, step)
+	}
+	return schedule, nil
+}
+
+// WeightAt returns the weight scheduled at t, moving linearly from the previous step
+// to a step with ramp set. It returns false before the first step
+func (s WeightSchedule) WeightAt(t time.Time) (int, bool) {
+	i := 0
+	for i < len(s) && !s[i].at.After(t) {
+		i++
+	}
+	if i == 0 {
+		return 0, false
+	}
+	prev := s[i-1]
+	if i == len(s) || !s[i].ramp {
+		return prev.weight, true
+	}
+	next := s[i]
+	progress := float64(t.Sub(prev.at)) / float64(next.at.Sub(prev.at))
+	return prev.weight + int(progress*float64(next.weight-prev.weight)), true
+}
+
+// applyWeightSchedules sets the scheduled weight of every backend whose schedule moved
+// since the last run, leaving weights changed through the admin api alone until then
+func applyWeightSchedules(now time.Time, applied map[*Backend]int) {
+	for _, pool := range currentRouter().Pools() {
+		for _, b := range pool.Backends() {
+			weight, ok := b.Schedule.WeightAt(now)
+			if !ok {
+				continue
+			}
+			if last, seen := applied[b]; seen && last == weight {
+				continue
+			}
+			applied[b] = weight
+			if b.Weight() != weight {
+				b.SetWeight(weight)
+				logInfof("Scheduled weight: %s (pool %s) weight %d\n", b.URL, pool.Name(), weight)
+			}
+		}
+	}
+}
+
+// runWeightSchedules periodically applies the weight schedules until ctx is done
+func runWeightSchedules(ctx context.Context) {
+	applied := make(map[*Backend]int)
+	t := time.NewTicker(weightScheduleInterval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			applyWeightSchedules(now, applied)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// selfTestTimeout bounds the self-test request of a backend
+const selfTestTimeout = 10 * time.Second
+
+// selfTest is a self-test request in flight, pinned to its backend
+type selfTest struct {
+	backend *Backend
+	pool    *ServerPool // the pool the request was routed to, if any
+	routed  bool        // the request made it through the load balancer to the backend
+}
+
+// selfTestOf returns the self-test r belongs to, nil for client requests
+func selfTestOf(r *http.Request) *selfTest {
+	test, _ := r.Context().Value(selfTestKey).(*selfTest)
+	return test
+}
+
+// selfTestWriter keeps the status of a self-test response and discards its body
+type selfTestWriter struct {
+	header http.Header
+	status int
+}
+
+// Header returns the response headers
+func (w *selfTestWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader keeps the first status code
+func (w *selfTestWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+// Write discards the body
+func (w *selfTestWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+// SelfTest sends a GET request for the self-test path of its pool, -selftest-path unless
+// the pool has its own, to every backend of every pool through the load balancer handler,
+// as a client request would go with the base path, ACL, routes and backend paths and
+// headers, only pinned to the backend and never retried. It logs the outcome of each
+// backend and returns how many failed, answering with an error status, routed to
+// another pool or not reached at all
+func SelfTest() int {
+	failed := 0
+	for _, pool := range currentRouter().Pools() {
+		for _, b := range pool.Backends() {
+			if err := selfTestBackend(pool, b); err != nil {
+				logErrorf("Self-test of %s (pool %s) failed: %v\n", b.URL, pool.Name(), err)
+				failed++
+				continue
+			}
+			logInfof("Self-test of %s (pool %s) passed\n", b.URL, pool.Name())
+		}
+	}
+	return failed
+}
+
+// selfTestBackend sends the self-test request to b of pool, with the Host of -selftest-host
+// or else the one of b
+func selfTestBackend(pool *ServerPool, b *Backend) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	test := &selfTest{backend: b}
+	ctx = context.WithValue(ctx, selfTestKey, test)
+	ctx = context.WithValue(ctx, policyKey, &requestPolicy{RoutePolicy: RoutePolicy{MaxAttempts: 1}})
+
+	path := pool.SelfTestPath
+	if path == "" {
+		path = cfg.SelfTestPath
+	}
+	uri := cfg.BasePath + path
+	r, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	r.RequestURI = uri
+	r.Host = cfg.SelfTestHost
+	if r.Host == "" {
+		r.Host = b.URL.Host
+	}
+	r.RemoteAddr = "127.0.0.1:0"
+
+	w := &selfTestWriter{header: make(http.Header)}
+	Handler().ServeHTTP(w, r)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	switch {
+	case test.pool != nil && test.pool != pool:
+		return fmt.Errorf("%s is routed to pool %s, give pool %s a selftest_path it routes", path, test.pool.Name(), pool.Name())
+	case !test.routed:
+		return fmt.Errorf("the load balancer answered %d without reaching the backend", w.status)
+	case w.status >= http.StatusBadRequest:
+		return fmt.Errorf("status %d", w.status)
+	}
+	return nil
+}
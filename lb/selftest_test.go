@@ -0,0 +1,49 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSelfTestRoutesThroughThePool(t *testing.T) {
+	hosts := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+	}))
+	defer backend.Close()
+	if err := Configure(DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(DefaultConfig())
+
+	u, _ := url.Parse(backend.URL)
+	defaultPool := NewServerPool(DefaultPool, &RoundRobin{})
+	defaultPool.AddBackend(NewBackend(u))
+	api := NewServerPool("api", &RoundRobin{})
+	api.AddBackend(NewBackend(u))
+	rt := NewRouter()
+	rt.AddPool(defaultPool)
+	rt.AddPool(api)
+	if err := rt.AddRoute("^/api/", BodyMatch{}, "api"); err != nil {
+		t.Fatal(err)
+	}
+	SetRouter(rt)
+
+	// the default path is not routed to the api pool
+	if err := selfTestBackend(api, api.Backends()[0]); err == nil || !strings.Contains(err.Error(), "routed to pool default") {
+		t.Errorf("self-test of a pool its path is not routed to = %v, want routed to pool default", err)
+	}
+	api.SelfTestPath = "/api/health"
+	if err := selfTestBackend(api, api.Backends()[0]); err != nil {
+		t.Errorf("self-test with the path of the pool: %v", err)
+	}
+	if err := selfTestBackend(defaultPool, defaultPool.Backends()[0]); err != nil {
+		t.Errorf("self-test of the default pool: %v", err)
+	}
+	if host := <-hosts; host != u.Host {
+		t.Errorf("backend got Host %q, want its own %q", host, u.Host)
+	}
+}
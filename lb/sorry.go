@@ -0,0 +1,37 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// NewSorryServer creates the handler proxying to the sorry server at u, such as an app
+// serving a maintenance page, for a pool none of whose backends is available. It is
+// never health checked nor retried, when it fails as well the client gets a 503
+func NewSorryServer(u *url.URL) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = transport
+	proxy.FlushInterval = cfg.FlushInterval
+	proxy.BufferPool = proxyBuffers
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		countHop(req)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
+		logWarnf("[%s] Sorry server failed, error=%q\n", u.Host, e.Error())
+		unavailable(w, r)
+	}
+	return proxy
+}
+
+// parseSorryServer parses the url of a sorry server
+func parseSorryServer(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid sorry server %q", redactURLs(raw))
+	}
+	return u, nil
+}
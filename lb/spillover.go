@@ -0,0 +1,68 @@
+package lb
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// TierSpillover sends part of the traffic of a priority tier on to the next tier. Share
+// is sent at all times to keep the next tier warm, once the active connections of the
+// tier exceed Threshold of their max_conns the share grows linearly up to all of the
+// traffic when the tier is full
+type TierSpillover struct {
+	Share     float64 `json:"share,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// fraction returns the fraction of the traffic of tier to spill over
+func (t TierSpillover) fraction(tier []*Backend) float64 {
+	var conns, capacity int64
+	for _, b := range tier {
+		if b.MaxConns > 0 && b.IsAvailable() {
+			conns += b.ActiveConnections()
+			capacity += b.MaxConns
+		}
+	}
+	share := t.Share
+	if capacity > 0 {
+		used := float64(conns) / float64(capacity)
+		if used > t.Threshold {
+			share += (1 - share) * math.Min(1, (used-t.Threshold)/(1-t.Threshold))
+		}
+	}
+	return share
+}
+
+// spilloverTier returns the backends of the tier to pick from, starting at the lowest
+// priority with an available backend and moving on to the next available tier as
+// often as the spillover of the tier says. All backends are returned when none is available
+func spilloverTier(backends []*Backend, spillover map[int]TierSpillover) []*Backend {
+	tiers := make(map[int][]*Backend)
+	var available []int
+	for _, b := range backends {
+		tiers[b.Priority] = append(tiers[b.Priority], b)
+	}
+	for priority, tier := range tiers {
+		for _, b := range tier {
+			if b.IsAvailable() {
+				available = append(available, priority)
+				break
+			}
+		}
+	}
+	if len(available) == 0 {
+		return backends
+	}
+	sort.Ints(available)
+
+	for i, priority := range available[:len(available)-1] {
+		tier := tiers[priority]
+		spill, ok := spillover[priority]
+		if !ok || rand.Float64() >= spill.fraction(tier) {
+			return tier
+		}
+		logDebugf("Spilling over from tier %d to tier %d\n", priority, available[i+1])
+	}
+	return tiers[available[len(available)-1]]
+}
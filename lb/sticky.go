@@ -0,0 +1,103 @@
+package lb
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stickyID identifies the backend at rawurl in the sticky cookie without revealing its address
+func stickyID(rawurl string) string {
+	h := fnv.New64a()
+	h.Write([]byte(rawurl))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// stickyDrainGrace is how long clients pinned to a draining backend keep reaching it,
+// -sticky-drain-grace or the lifetime of the sticky cookie when not set
+func stickyDrainGrace() time.Duration {
+	if cfg.StickyDrainGrace > 0 {
+		return cfg.StickyDrainGrace
+	}
+	return cfg.StickyTTL
+}
+
+// acceptsSticky returns true when clients pinned to b may still be sent to it,
+// while it is alive and not draining for longer than the grace period
+func (b *Backend) acceptsSticky(now time.Time) bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	if !b.Alive {
+		return false
+	}
+	return b.drainStart.IsZero() || now.Sub(b.drainStart) < stickyDrainGrace()
+}
+
+// StickyPeer returns the backend the client of r is pinned to by its sticky cookie,
+// nil when sticky sessions are disabled, the client is not pinned or its backend
+// cannot take it anymore
+func (s *ServerPool) StickyPeer(r *http.Request) *Backend {
+	if cfg.StickyCookie == "" {
+		return nil
+	}
+	cookie, err := r.Cookie(cfg.StickyCookie)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	for _, b := range s.Backends() {
+		if b.stickyID == cookie.Value {
+			if b.acceptsSticky(now) {
+				return b
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// stickySameSite is the SameSite attribute of the sticky cookie parsed from -sticky-cookie-samesite
+var stickySameSite http.SameSite
+
+// parseSameSite parses a SameSite attribute, empty leaves it out
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("invalid sticky cookie SameSite %q, expected lax, strict or none", value)
+}
+
+// setStickyCookie pins the client of response to b, unless it already is. The cookie is
+// added next to those of the backend, and left out when the backend sets a cookie of the
+// same name itself so that one is not clobbered
+func setStickyCookie(response *http.Response, b *Backend) {
+	if cookie, err := response.Request.Cookie(cfg.StickyCookie); err == nil && cookie.Value == b.stickyID {
+		return
+	}
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == cfg.StickyCookie {
+			logWarnf("[%s] Backend sets the sticky cookie %s itself, not pinning the client\n", b.URL.Host, cfg.StickyCookie)
+			return
+		}
+	}
+	cookie := &http.Cookie{
+		Name:     cfg.StickyCookie,
+		Value:    b.stickyID,
+		Path:     cfg.StickyCookiePath,
+		MaxAge:   int(cfg.StickyTTL / time.Second),
+		Secure:   cfg.StickyCookieSecure,
+		HttpOnly: true,
+		SameSite: stickySameSite,
+	}
+	response.Header.Add("Set-Cookie", cookie.String())
+}
@@ -0,0 +1,270 @@
+package lb
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer is a strategy which picks the backend to serve the next request
+type Balancer interface {
+	// Next returns an alive backend out of backends or nil when there is none
+	Next(backends []*Backend) *Backend
+}
+
+// balancers holds the constructors of the available strategies by name
+var balancers = map[string]func() Balancer{
+	"round-robin":          func() Balancer { return &RoundRobin{} },
+	"least-time":           func() Balancer { return &LeastTime{} },
+	"weighted-round-robin": func() Balancer { return &WeightedRoundRobin{} },
+}
+
+// newBalancer creates the strategy registered with name, or the chain of the comma
+// separated strategies registered with the names in name
+func newBalancer(name string) (Balancer, error) {
+	if strings.Contains(name, ",") {
+		chain := &Chain{}
+		for _, link := range strings.Split(name, ",") {
+			balancer, err := newBalancer(strings.TrimSpace(link))
+			if err != nil {
+				return nil, err
+			}
+			chain.Balancers = append(chain.Balancers, balancer)
+		}
+		return chain, nil
+	}
+	constructor, ok := balancers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q", name)
+	}
+	// the constructors cannot refer to the config, which lists their names in its flags
+	if name == "round-robin" {
+		return NewRoundRobin(cfg.RoundRobinStart), nil
+	}
+	return constructor(), nil
+}
+
+// balancerNames returns the names of the available strategies
+func balancerNames() []string {
+	names := make([]string, 0, len(balancers))
+	for name := range balancers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// balancerName returns the name of the strategy implemented by b
+func balancerName(b Balancer) string {
+	switch b := b.(type) {
+	case *RoundRobin:
+		return "round-robin"
+	case *LeastTime:
+		return "least-time"
+	case *WeightedRoundRobin:
+		return "weighted-round-robin"
+	case *ZoneAware:
+		return balancerName(b.Balancer) + " (zone " + b.Zone + ")"
+	case *Chain:
+		names := make([]string, 0, len(b.Balancers))
+		for _, balancer := range b.Balancers {
+			names = append(names, balancerName(balancer))
+		}
+		return strings.Join(names, ",")
+	}
+	return fmt.Sprintf("%T", b)
+}
+
+// RoundRobin cycles through the alive backends in order, starting with the first
+type RoundRobin struct {
+	// index the next selection starts from, wrapped by the number of backends on use as
+	// the tiers and zones of a pool share the balancer with fewer backends each
+	current uint64
+}
+
+// NewRoundRobin returns a round robin starting with the backend at index start,
+// wrapped into range once the number of backends is known
+func NewRoundRobin(start int) *RoundRobin {
+	return &RoundRobin{current: uint64(start)}
+}
+
+// NextIndex returns the index the next selection starts from,
+// wrapped into range in case backends were removed since the last selection
+func (rr *RoundRobin) NextIndex(n int) int {
+	if n == 0 {
+		return 0
+	}
+	return int(atomic.LoadUint64(&rr.current) % uint64(n))
+}
+
+// Next returns the next available backend in the cycle
+func (rr *RoundRobin) Next(backends []*Backend) *Backend {
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+	for {
+		current := atomic.LoadUint64(&rr.current)
+		next := int(current % uint64(n))
+		var peer *Backend
+		for i := next; i < n+next; i++ { // start from next and move a full cycle
+			idx := i % n // take an index by modding
+			if backends[idx].IsAvailable() {
+				peer = backends[idx]
+				next = (idx + 1) % n
+				break
+			}
+		}
+		if peer == nil {
+			return nil
+		}
+		// continue after the chosen backend, retrying if another request moved the counter first
+		if atomic.CompareAndSwapUint64(&rr.current, current, uint64(next)) {
+			return peer
+		}
+	}
+}
+
+// LeastTime picks two random available backends and routes to the one with the lower
+// latency weighted by its active connections (power of two choices over ewma)
+type LeastTime struct{}
+
+// cost estimates how long a new request to b would take
+func (LeastTime) cost(b *Backend) float64 {
+	return float64(b.Latency()+1) * float64(b.ActiveConnections()+1)
+}
+
+// Declines while none of the available backends has a measured latency, before the
+// first responses of a pool every backend would look the same
+func (LeastTime) Declines(backends []*Backend) bool {
+	for _, b := range backends {
+		if b.IsAvailable() && b.Latency() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Next returns the cheaper of two randomly chosen available backends
+func (lt LeastTime) Next(backends []*Backend) *Backend {
+	alive := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b.IsAvailable() {
+			alive = append(alive, b)
+		}
+	}
+
+	switch len(alive) {
+	case 0:
+		return nil
+	case 1:
+		return alive[0]
+	}
+
+	i := rand.Intn(len(alive))
+	j := rand.Intn(len(alive) - 1)
+	if j >= i {
+		j++
+	}
+	if lt.cost(alive[j]) < lt.cost(alive[i]) {
+		return alive[j]
+	}
+	return alive[i]
+}
+
+// WeightedRoundRobin spreads requests over the available backends in proportion
+// to their weights, interleaving them smoothly instead of sending bursts
+type WeightedRoundRobin struct {
+	mux     sync.Mutex
+	current map[*Backend]float64
+}
+
+// Next returns the available backend furthest behind its share of traffic
+func (wrr *WeightedRoundRobin) Next(backends []*Backend) *Backend {
+	wrr.mux.Lock()
+	defer wrr.mux.Unlock()
+
+	current := make(map[*Backend]float64, len(backends))
+	var best *Backend
+	total := 0.0
+	for _, b := range backends {
+		if !b.IsAvailable() {
+			continue
+		}
+		weight := b.EffectiveWeight()
+		current[b] = wrr.current[b] + weight
+		total += weight
+		if best == nil || current[b] > current[best] {
+			best = b
+		}
+	}
+	if best != nil {
+		current[best] -= total
+	}
+	// backends which left the rotation start over when they are back
+	wrr.current = current
+	return best
+}
+
+// zoneTag is the backend tag holding the zone of a backend
+const zoneTag = "zone"
+
+// ZoneAware keeps traffic in the local zone, spilling over to every zone
+// when too few of the local backends are available
+type ZoneAware struct {
+	Zone string
+	// MinAvailable is the fraction of local backends which must be available
+	// to keep the traffic local
+	MinAvailable float64
+	Balancer     Balancer
+}
+
+// Next picks from the local backends while enough of them are available
+func (za *ZoneAware) Next(backends []*Backend) *Backend {
+	local := make([]*Backend, 0, len(backends))
+	available := 0
+	for _, b := range backends {
+		if b.Tags[zoneTag] == za.Zone {
+			local = append(local, b)
+			if b.IsAvailable() {
+				available++
+			}
+		}
+	}
+
+	if available > 0 && float64(available)/float64(len(local)) >= za.MinAvailable {
+		return za.Balancer.Next(local)
+	}
+	return za.Balancer.Next(backends)
+}
+
+// Decliner is implemented by strategies which only apply to some backends, such as
+// those relying on measurements the backends do not have yet
+type Decliner interface {
+	// Declines returns true when the strategy cannot make a meaningful pick out of backends
+	Declines(backends []*Backend) bool
+}
+
+// Chain asks its strategies in order and the first which does not decline picks. A
+// strategy declines when it is a Decliner declining the backends or when it picks
+// none, so a chain ending with a strategy which never declines, such as round-robin,
+// always picks an available backend
+type Chain struct {
+	Balancers []Balancer
+}
+
+// Next returns the backend picked by the first strategy which does not decline
+func (c *Chain) Next(backends []*Backend) *Backend {
+	for _, balancer := range c.Balancers {
+		if d, ok := balancer.(Decliner); ok && d.Declines(backends) {
+			continue
+		}
+		if peer := balancer.Next(backends); peer != nil {
+			return peer
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package lb
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRoundRobinEmpty(t *testing.T) {
+	rr := &RoundRobin{}
+	if peer := rr.Next(nil); peer != nil {
+		t.Errorf("Next of no backends = %s, want nil", peer.URL)
+	}
+	if idx := rr.NextIndex(0); idx != 0 {
+		t.Errorf("NextIndex(0) = %d, want 0", idx)
+	}
+}
+
+func TestRoundRobinConcurrent(t *testing.T) {
+	backends := testBackends(t, 3)
+	rr := &RoundRobin{}
+	picks := make([]int64, len(backends))
+	index := make(map[*Backend]int, len(backends))
+	for i, b := range backends {
+		index[b] = i
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				peer := rr.Next(backends)
+				if peer == nil {
+					t.Error("no backend picked out of alive ones")
+					return
+				}
+				atomic.AddInt64(&picks[index[peer]], 1)
+				if current := atomic.LoadUint64(&rr.current); current >= uint64(len(backends)) {
+					t.Errorf("counter %d out of range", current)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every selection moves the counter by one, so the picks are spread evenly
+	for i, n := range picks {
+		if n != 800 {
+			t.Errorf("backend %d picked %d times, want 800", i, n)
+		}
+	}
+}
+
+func TestRoundRobinConcurrentWithDeadBackends(t *testing.T) {
+	backends := testBackends(t, 4)
+	rr := &RoundRobin{}
+	stop := make(chan struct{})
+	flipped := make(chan struct{})
+	// backend 0 stays alive so every selection finds one, the others come and go
+	go func() {
+		defer close(flipped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			b := backends[1+i%3]
+			b.SetAlive(!b.IsAlive())
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if peer := rr.Next(backends); peer == nil {
+					t.Error("no backend picked while one is alive")
+					return
+				}
+				if current := atomic.LoadUint64(&rr.current); current >= uint64(len(backends)) {
+					t.Errorf("counter %d out of range", current)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-flipped
+}
+
+func TestRoundRobinStart(t *testing.T) {
+	backends := testBackends(t, 3)
+	if peer := NewRoundRobin(1).Next(backends); peer != backends[1] {
+		t.Errorf("first pick = %s, want %s", peer.URL, backends[1].URL)
+	}
+	// a start beyond the backends wraps around
+	rr := NewRoundRobin(5)
+	if idx := rr.NextIndex(len(backends)); idx != 2 {
+		t.Errorf("NextIndex = %d, want 2", idx)
+	}
+	if peer := rr.Next(backends); peer != backends[2] {
+		t.Errorf("first pick = %s, want %s", peer.URL, backends[2].URL)
+	}
+	if current := atomic.LoadUint64(&rr.current); current != 0 {
+		t.Errorf("counter = %d after picking the last backend, want 0", current)
+	}
+}
@@ -0,0 +1,119 @@
+package lb
+
+import (
+	"sync"
+	"time"
+)
+
+// successBuckets is the number of buckets a SuccessWindow splits its window into
+const successBuckets = 10
+
+// minSuccessSamples is the number of requests within the window below which the
+// success rate is too noisy to lower the weight of a backend
+const minSuccessSamples = 20
+
+// minSuccessShare keeps at least this share of a failing backend's weight so its
+// success rate keeps being sampled
+const minSuccessShare = 0.1
+
+// outcomeBucket counts the requests of a slice of the window
+type outcomeBucket struct {
+	slot      int64 // index of the slice of time counted, the bucket is stale when it moved on
+	total     int64
+	succeeded int64
+}
+
+// SuccessWindow keeps the rolling success rate of the requests of a backend,
+// counted in buckets so it costs the same however busy the backend is
+type SuccessWindow struct {
+	mux     sync.Mutex
+	buckets [successBuckets]outcomeBucket
+}
+
+// NewSuccessWindow creates a window without requests
+func NewSuccessWindow() *SuccessWindow {
+	return &SuccessWindow{}
+}
+
+// successSlot returns the index of the slice of window now falls in
+func successSlot(now time.Time, window time.Duration) int64 {
+	width := int64(window) / successBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return now.UnixNano() / width
+}
+
+// Record counts a request at now which succeeded or not
+func (w *SuccessWindow) Record(now time.Time, window time.Duration, succeeded bool) {
+	slot := successSlot(now, window)
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	bucket := &w.buckets[slot%successBuckets]
+	if bucket.slot != slot {
+		*bucket = outcomeBucket{slot: slot}
+	}
+	bucket.total++
+	if succeeded {
+		bucket.succeeded++
+	}
+}
+
+// Rate returns the share of the requests within window before now which succeeded,
+// along with the number of requests counted
+func (w *SuccessWindow) Rate(now time.Time, window time.Duration) (float64, int64) {
+	slot := successSlot(now, window)
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	var total, succeeded int64
+	for _, bucket := range w.buckets {
+		if slot-bucket.slot < successBuckets {
+			total += bucket.total
+			succeeded += bucket.succeeded
+		}
+	}
+	if total == 0 {
+		return 1, 0
+	}
+	return float64(succeeded) / float64(total), total
+}
+
+// Reset forgets the requests
+func (w *SuccessWindow) Reset() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.buckets = [successBuckets]outcomeBucket{}
+}
+
+// recordOutcome counts a request of this backend towards its success rate when
+// -success-rate-window is set
+func (b *Backend) recordOutcome(succeeded bool) {
+	if b.outcomes != nil {
+		b.outcomes.Record(time.Now(), cfg.SuccessRateWindow, succeeded)
+	}
+}
+
+// SuccessRate returns the share of the requests of this backend within -success-rate-window
+// which succeeded, false when it is not set. Rates of too few requests are reported as 1
+func (b *Backend) SuccessRate() (float64, bool) {
+	if b.outcomes == nil {
+		return 0, false
+	}
+	rate, total := b.outcomes.Rate(time.Now(), cfg.SuccessRateWindow)
+	if total < minSuccessSamples {
+		return 1, true
+	}
+	return rate, true
+}
+
+// successShare returns the share of the weight this backend keeps for its success rate
+func (b *Backend) successShare() float64 {
+	rate, ok := b.SuccessRate()
+	if !ok {
+		return 1
+	}
+	if rate < minSuccessShare {
+		return minSuccessShare
+	}
+	return rate
+}
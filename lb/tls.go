@@ -0,0 +1,154 @@
+package lb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// tlsVersions are the TLS versions by their -tls-min-version name
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuites are the TLS 1.0 to 1.2 cipher suites which may be allowed with -tls-ciphers
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// insecureCipherSuites are the cipher suites refused by -tls-ciphers, broken by RC4 or
+// 3DES or open to Lucky13 timing attacks with CBC and SHA-256
+var insecureCipherSuites = map[string]bool{
+	"TLS_RSA_WITH_RC4_128_SHA":                true,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           true,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":         true,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        true,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          true,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     true,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": true,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   true,
+}
+
+// tls13CipherSuites are the cipher suites of TLS 1.3, always enabled
+var tls13CipherSuites = map[string]uint16{
+	"TLS_AES_128_GCM_SHA256":       tls.TLS_AES_128_GCM_SHA256,
+	"TLS_AES_256_GCM_SHA384":       tls.TLS_AES_256_GCM_SHA384,
+	"TLS_CHACHA20_POLY1305_SHA256": tls.TLS_CHACHA20_POLY1305_SHA256,
+}
+
+// tlsMinVersion and tlsCipherSuites are parsed from -tls-min-version and -tls-ciphers,
+// tlsClientCAs from -tls-client-ca
+var (
+	tlsMinVersion   uint16
+	tlsCipherSuites []uint16
+	tlsClientCAs    *x509.CertPool
+)
+
+// tlsVersionName returns the -tls-min-version name of version
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// cipherSuiteName returns the name of the cipher suite id
+func cipherSuiteName(id uint16) string {
+	for _, suites := range []map[string]uint16{cipherSuites, tls13CipherSuites} {
+		for name, suite := range suites {
+			if suite == id {
+				return name
+			}
+		}
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
+
+// parseTLSSettings parses -tls-min-version and -tls-ciphers, refusing insecure cipher
+// suites and combinations which can not work
+func parseTLSSettings() error {
+	var ok bool
+	if tlsMinVersion, ok = tlsVersions[cfg.TLSMinVersion]; !ok {
+		return fmt.Errorf("invalid TLS version %q, expected one of 1.0, 1.1, 1.2, 1.3", cfg.TLSMinVersion)
+	}
+
+	tlsClientCAs = nil
+	if cfg.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return err
+		}
+		tlsClientCAs = x509.NewCertPool()
+		if !tlsClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in the client CA file %s", cfg.TLSClientCA)
+		}
+	}
+
+	tlsCipherSuites = nil
+	var names []string
+	for _, list := range cfg.TLSCiphers {
+		names = append(names, strings.Split(list, ",")...)
+	}
+	http2Cipher := false
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if insecureCipherSuites[name] {
+			return fmt.Errorf("cipher suite %s is insecure", name)
+		}
+		suite, ok := cipherSuites[name]
+		if !ok {
+			return fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if suite == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suite == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			http2Cipher = true
+		}
+		tlsCipherSuites = append(tlsCipherSuites, suite)
+	}
+	if len(tlsCipherSuites) == 0 {
+		return nil
+	}
+	if tlsMinVersion == tls.VersionTLS13 {
+		return errors.New("cipher suites can not be chosen with a TLS min version of 1.3, its suites are all secure")
+	}
+	if cfg.HTTP2 && !http2Cipher {
+		return errors.New("HTTP/2 needs TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 in the cipher suites, add one or disable -http2")
+	}
+	return nil
+}
+
+// newServerTLSConfig returns the TLS config of the client facing server, serving the
+// certificates of getCertificate with the TLS versions and cipher suites allowed. With a
+// client CA the certificates clients present are verified against it
+func newServerTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	config := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tlsMinVersion,
+		CipherSuites:   tlsCipherSuites,
+	}
+	if tlsClientCAs != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = tlsClientCAs
+	}
+	return config
+}
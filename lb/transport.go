@@ -0,0 +1,249 @@
+package lb
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// transport holds the settings to reach the backends, each backend proxies
+// through a clone of it and health checks use it directly
+var transport *http.Transport
+
+// backendDialTimeout bounds connecting to a backend for proxied requests
+const backendDialTimeout = 30 * time.Second
+
+// newDialer creates a dialer for the backends. Hosts with both IPv4 and IPv6
+// addresses are dialed happy eyeballs style, racing the other address family
+// after -dial-fallback-delay so a dead family does not hang the connection
+func newDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:       timeout,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: cfg.DialFallbackDelay,
+	}
+}
+
+// newTransport creates the transport used to reach the backends
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = newDialer(backendDialTimeout).DialContext
+	t.Proxy = func(r *http.Request) (*url.URL, error) {
+		return proxyFor(r.URL)
+	}
+	t.ResponseHeaderTimeout = cfg.ResponseTimeout
+	// the primed connections must fit in the idle pool of each backend
+	if cfg.WarmConnections > http.DefaultMaxIdleConnsPerHost {
+		t.MaxIdleConnsPerHost = cfg.WarmConnections
+	}
+	return t
+}
+
+// validateProxy checks the upstream proxy url is one we know how to dial
+func validateProxy(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("upstream proxy %q has no host", raw)
+	}
+	return nil
+}
+
+// proxyFor returns the proxy to reach the backend at u, or nil to connect directly.
+// The -upstream-proxy flag takes precedence over the HTTP_PROXY style environment
+func proxyFor(u *url.URL) (*url.URL, error) {
+	if cfg.UpstreamProxy != "" {
+		return url.Parse(cfg.UpstreamProxy)
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: u})
+}
+
+// hostPort returns the host and port of u, using the default port of its scheme
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// dialBackend opens a TCP connection to the backend at u, tunneling through the upstream proxy if any
+func dialBackend(u *url.URL, timeout time.Duration) (net.Conn, error) {
+	addr := hostPort(u)
+	proxyUrl, err := proxyFor(u)
+	if err != nil {
+		return nil, err
+	}
+	dialer := newDialer(timeout)
+	if proxyUrl == nil {
+		return dialer.Dial("tcp", addr)
+	}
+
+	conn, err := dialer.Dial("tcp", hostPort(proxyUrl))
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	switch proxyUrl.Scheme {
+	case "socks5":
+		err = socks5Connect(conn, proxyUrl, addr)
+	case "https":
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyUrl.Hostname()})
+		err = httpConnect(conn, proxyUrl, addr)
+	default:
+		err = httpConnect(conn, proxyUrl, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, conn.SetDeadline(time.Time{})
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to addr
+func httpConnect(conn net.Conn, proxyUrl *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		req.SetBasicAuth(proxyUrl.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused tunnel to %s: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// socks5Connect asks a SOCKS5 proxy to open a tunnel to addr, see RFC 1928 and RFC 1929
+func socks5Connect(conn net.Conn, proxyUrl *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	// negotiate the authentication method
+	methods := []byte{0x00}
+	if proxyUrl.User != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return errors.New("socks5: unexpected protocol version")
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		user := proxyUrl.User.Username()
+		password, _ := proxyUrl.User.Password()
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5: authentication failed")
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	// request the tunnel
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("socks5: proxy refused tunnel to %s with code %d", addr, header[1])
+	}
+
+	// skip the bound address and port
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0]) + 2
+	default:
+		return errors.New("socks5: unexpected address type")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
@@ -0,0 +1,71 @@
+package lb
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// primeConnections opens -warm-connections idle connections to b at once, so its
+// first requests skip the TCP and TLS handshakes
+func primeConnections(b *Backend) {
+	n, path := cfg.WarmConnections, cfg.WarmupPath
+	if n <= 0 {
+		return
+	}
+	openConnections(context.Background(), b, n, path)
+}
+
+// startPriming primes the connections to b in the background until the load balancer
+// stops. The settings are read by the caller, so a later Configure does not race with it
+func startPriming(b *Backend) {
+	n, path := cfg.WarmConnections, cfg.WarmupPath
+	if n <= 0 {
+		return
+	}
+	goBackground(func(ctx context.Context) { openConnections(ctx, b, n, path) })
+}
+
+// openConnections opens n idle connections to b at once by sending HEAD requests to path
+func openConnections(ctx context.Context, b *Backend, n int, path string) {
+	client := http.Client{Transport: b.transport, Timeout: 10 * time.Second}
+	u := b.authURL()
+	u.Path = singleJoiningSlash(u.Path, path)
+
+	var opened int64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+			if err != nil {
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			atomic.AddInt64(&opened, 1)
+		}()
+	}
+	wg.Wait()
+	logDebugf("Primed %d of %d connections to %s\n", opened, n, b.URL)
+}
+
+// primeBackends primes the connections to every alive backend of the router
+func primeBackends() {
+	for _, pool := range currentRouter().Pools() {
+		for _, b := range pool.Backends() {
+			if b.IsAlive() {
+				startPriming(b)
+			}
+		}
+	}
+}
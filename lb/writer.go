@@ -0,0 +1,109 @@
+package lb
+
+import (
+	"bufio"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// streamingTypes are the response media types flushed to the client on every write
+var streamingTypes = map[string]bool{
+	"text/event-stream": true,
+}
+
+// isStreaming returns true when the content type belongs to a streaming response
+func isStreaming(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return streamingTypes[mediaType]
+}
+
+// normalizeFraming leaves a backend response with exactly one framing, the length its
+// body was read with or chunked when that is unknown. Backends sending both a
+// Content-Length and chunked encoding, or HTTP/1.0 backends closing the connection
+// after a body of unknown length, otherwise confuse clients
+func normalizeFraming(response *http.Response) {
+	response.Header.Del("Transfer-Encoding")
+	switch {
+	case response.StatusCode < 200 || response.StatusCode == http.StatusNoContent:
+		// no body to frame, nor a length to announce
+		response.Header.Del("Content-Length")
+	case response.StatusCode == http.StatusNotModified:
+		// the length is the one of the cached body, if given
+	case response.ContentLength >= 0:
+		response.Header.Set("Content-Length", strconv.FormatInt(response.ContentLength, 10))
+	default:
+		response.Header.Del("Content-Length")
+	}
+}
+
+// responseWriter wraps the client http.ResponseWriter so streaming responses
+// are flushed as soon as the backend writes them
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	streaming   bool
+	status      int   // first status code written
+	written     int64 // body bytes written
+}
+
+// newResponseWriter wraps w, reusing it if it is already wrapped
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w}
+}
+
+// WriteHeader detects streaming responses before sending the status code
+func (rw *responseWriter) WriteHeader(code int) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.status = code
+		rw.streaming = isStreaming(rw.Header().Get("Content-Type"))
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Write sends b to the client, flushing immediately for streaming responses
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.written += int64(n)
+	if rw.streaming {
+		rw.Flush()
+	}
+	return n, err
+}
+
+// Flush sends any buffered data to the client
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// canHijack returns true when the connection behind w can be taken over
+func canHijack(w http.ResponseWriter) bool {
+	if rw, ok := w.(*responseWriter); ok {
+		w = rw.ResponseWriter
+	}
+	_, ok := w.(http.Hijacker)
+	return ok
+}
+
+// Hijack lets the reverse proxy take over the connection for protocol upgrades
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return h.Hijack()
+}
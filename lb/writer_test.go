@@ -0,0 +1,84 @@
+package lb
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeFraming(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		wantErr  bool
+		wantCL   string
+		wantBody string
+	}{
+		{
+			name:     "content length",
+			raw:      "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nbody",
+			wantCL:   "4",
+			wantBody: "body",
+		},
+		{
+			name:     "chunked",
+			raw:      "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n",
+			wantBody: "body",
+		},
+		{
+			name:     "content length and chunked",
+			raw:      "HTTP/1.1 200 OK\r\nContent-Length: 100\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n",
+			wantBody: "body",
+		},
+		{
+			name:     "duplicate content length",
+			raw:      "HTTP/1.1 200 OK\r\nContent-Length: 4\r\nContent-Length: 4\r\n\r\nbody",
+			wantCL:   "4",
+			wantBody: "body",
+		},
+		{
+			name:    "conflicting content length",
+			raw:     "HTTP/1.1 200 OK\r\nContent-Length: 4\r\nContent-Length: 5\r\n\r\nbody",
+			wantErr: true,
+		},
+		{
+			name: "no content with length",
+			raw:  "HTTP/1.1 204 No Content\r\nContent-Length: 4\r\n\r\n",
+		},
+		{
+			name:   "not modified with length",
+			raw:    "HTTP/1.1 304 Not Modified\r\nContent-Length: 4\r\n\r\n",
+			wantCL: "4",
+		},
+	}
+	for _, tt := range tests {
+		response, err := http.ReadResponse(bufio.NewReader(strings.NewReader(tt.raw)), nil)
+		if tt.wantErr {
+			// the transport refuses the response, the proxy answers it with a 502
+			if err == nil {
+				t.Errorf("%s: response accepted", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		normalizeFraming(response)
+
+		if te := response.Header.Get("Transfer-Encoding"); te != "" {
+			t.Errorf("%s: Transfer-Encoding %q kept", tt.name, te)
+		}
+		if cl := response.Header["Content-Length"]; len(cl) > 1 || strings.Join(cl, "") != tt.wantCL {
+			t.Errorf("%s: Content-Length = %q, want %q", tt.name, cl, tt.wantCL)
+		}
+		body := new(strings.Builder)
+		if _, err := bufio.NewReader(response.Body).WriteTo(body); err != nil {
+			t.Errorf("%s: reading body: %v", tt.name, err)
+		}
+		if body.String() != tt.wantBody {
+			t.Errorf("%s: body = %q, want %q", tt.name, body, tt.wantBody)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package lb
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// headers telling backends about the TLS connection of the client with -forward-client-tls
+const (
+	clientCertHeader = "X-Forwarded-Client-Cert"
+	tlsVersionHeader = "X-Forwarded-Tls-Version"
+	tlsCipherHeader  = "X-Forwarded-Tls-Cipher"
+)
+
+// forwardClientTLS tells the backend whether the client of req connected over TLS, with
+// which version and cipher suite and which certificate it presented. Whatever the client
+// sent in these headers is replaced so it can not pass as another client
+func forwardClientTLS(req *http.Request) {
+	req.Header.Del(clientCertHeader)
+	req.Header.Del(tlsVersionHeader)
+	req.Header.Del(tlsCipherHeader)
+	if req.TLS == nil {
+		req.Header.Set("X-Forwarded-Proto", "http")
+		return
+	}
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set(tlsVersionHeader, tlsVersionName(req.TLS.Version))
+	req.Header.Set(tlsCipherHeader, cipherSuiteName(req.TLS.CipherSuite))
+	if len(req.TLS.PeerCertificates) > 0 {
+		req.Header.Set(clientCertHeader, clientCertValue(req.TLS.PeerCertificates[0]))
+	}
+}
+
+// clientCertValue describes cert the way Envoy does in X-Forwarded-Client-Cert, by the
+// SHA-256 hash of its DER, its URL encoded PEM, its subject and its URI and DNS SANs
+func clientCertValue(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	encoded := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	parts := []string{
+		"Hash=" + hex.EncodeToString(sum[:]),
+		`Cert="` + strings.Replace(url.QueryEscape(encoded), "+", "%20", -1) + `"`,
+		`Subject="` + strings.Replace(cert.Subject.String(), `"`, `\"`, -1) + `"`,
+	}
+	for _, uri := range cert.URIs {
+		parts = append(parts, "URI="+uri.String())
+	}
+	for _, name := range cert.DNSNames {
+		parts = append(parts, "DNS="+name)
+	}
+	return strings.Join(parts, ";")
+}